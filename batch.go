@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"time"
+
+	"github.com/nbd-wtf/opentimestamps"
+)
+
+// the operations we need to build merkle paths, the library doesn't export its own
+var (
+	opAppend = &opentimestamps.Operation{Name: "append", Tag: 0xf0, Binary: true,
+		Apply: func(curr []byte, arg []byte) []byte { return append(append([]byte{}, curr...), arg...) }}
+	opPrepend = &opentimestamps.Operation{Name: "prepend", Tag: 0xf1, Binary: true,
+		Apply: func(curr []byte, arg []byte) []byte { return append(append([]byte{}, arg...), curr...) }}
+	opSHA256 = &opentimestamps.Operation{Name: "sha256", Tag: 0x08,
+		Apply: func(curr []byte, arg []byte) []byte { h := sha256.Sum256(curr); return h[:] }}
+)
+
+type stampRequest struct {
+	digest [32]byte
+	result chan stampResult
+}
+
+type stampResult struct {
+	seqs []opentimestamps.Sequence
+	err  error
+}
+
+var stampRequests = make(chan stampRequest)
+
+// requestStamp stamps digest on the calendars, going through batchStamps if STAMP_BATCH_WINDOW is set
+func requestStamp(ctx context.Context, digest [32]byte) ([]opentimestamps.Sequence, error) {
+	if s.StampBatchWindow <= 0 {
+		return stampOnCalendars(ctx, digest)
+	}
+
+	req := stampRequest{digest, make(chan stampResult, 1)}
+	select {
+	case stampRequests <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case res := <-req.result:
+		return res.seqs, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// batchStamps collects the digests that come in during STAMP_BATCH_WINDOW and submits them to the calendars
+// all at once as the root of a merkle tree
+func batchStamps(ctx context.Context) {
+	for {
+		var batch []stampRequest
+		select {
+		case req := <-stampRequests:
+			batch = append(batch, req)
+		case <-ctx.Done():
+			return
+		}
+
+		window := time.After(s.StampBatchWindow)
+	collect:
+		for {
+			select {
+			case req := <-stampRequests:
+				batch = append(batch, req)
+			case <-window:
+				break collect
+			case <-ctx.Done():
+				break collect
+			}
+		}
+
+		go stampBatch(ctx, batch)
+	}
+}
+
+func stampBatch(ctx context.Context, batch []stampRequest) {
+	type node struct {
+		hash   [32]byte
+		leaves []int
+	}
+
+	// paths[i] takes the digest of batch[i] to the root
+	paths := make([]opentimestamps.Sequence, len(batch))
+	level := make([]node, len(batch))
+	for i, req := range batch {
+		level[i] = node{req.digest, []int{i}}
+	}
+	for len(level) > 1 {
+		next := make([]node, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+
+			left, right := level[i], level[i+1]
+			for _, leaf := range left.leaves {
+				paths[leaf] = append(paths[leaf],
+					opentimestamps.Instruction{Operation: opAppend, Argument: right.hash[:]},
+					opentimestamps.Instruction{Operation: opSHA256},
+				)
+			}
+			for _, leaf := range right.leaves {
+				paths[leaf] = append(paths[leaf],
+					opentimestamps.Instruction{Operation: opPrepend, Argument: left.hash[:]},
+					opentimestamps.Instruction{Operation: opSHA256},
+				)
+			}
+
+			leaves := make([]int, 0, len(left.leaves)+len(right.leaves))
+			next = append(next, node{
+				hash:   sha256.Sum256(append(left.hash[:], right.hash[:]...)),
+				leaves: append(append(leaves, left.leaves...), right.leaves...),
+			})
+		}
+		level = next
+	}
+
+	seqs, err := stampOnCalendars(ctx, level[0].hash)
+	for i, req := range batch {
+		full := make([]opentimestamps.Sequence, len(seqs))
+		for j, seq := range seqs {
+			full[j] = append(append(opentimestamps.Sequence{}, paths[i]...), seq...)
+		}
+		req.result <- stampResult{full, err}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// watchBlocks subscribes to new blocks on a mempool.space-style websocket and signals on blocks every
+// time one arrives. it reconnects on failures; in the meantime we just keep polling on UPGRADE_INTERVAL.
+func watchBlocks(ctx context.Context, url string, blocks chan<- struct{}) {
+	for {
+		if err := readBlocks(ctx, url, blocks); err != nil && ctx.Err() == nil {
+			slog.Warn("blocks websocket failed", "url", url, "error", err)
+		}
+		if !sleep(ctx, s.ReconnectMaxDelay) {
+			return
+		}
+	}
+}
+
+func readBlocks(ctx context.Context, url string, blocks chan<- struct{}) error {
+	dialer := ws.Dialer{}
+	if proxyDialer != nil {
+		dialer.NetDial = proxyDialer.DialContext
+	}
+	conn, _, _, err := dialer.Dial(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// unblock the read below when we're shutting down
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if err := wsutil.WriteClientText(conn, []byte(`{"action":"want","data":["blocks"]}`)); err != nil {
+		return err
+	}
+	slog.Info("watching for new blocks", "url", url)
+
+	for {
+		msg, err := wsutil.ReadServerText(conn)
+		if err != nil {
+			return err
+		}
+
+		var update struct {
+			Block *struct {
+				Height int64  `json:"height"`
+				ID     string `json:"id"`
+			} `json:"block"`
+		}
+		if err := json.Unmarshal(msg, &update); err != nil || update.Block == nil {
+			continue
+		}
+
+		slog.Info("new block", "block_height", update.Block.Height, "block_hash", update.Block.ID)
+		select {
+		case blocks <- struct{}{}:
+		default:
+			// a pass is already due
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/nbd-wtf/opentimestamps"
+)
+
+// calendarUpgradeURLs maps calendars that changed address to where their commitments can be upgraded now
+var calendarUpgradeURLs = make(map[string]string)
+
+// parseCalendarUpgradeURLs reads entries like "https://old.example.com=https://new.example.com"
+func parseCalendarUpgradeURLs(entries []string) error {
+	for _, entry := range entries {
+		old, new, ok := strings.Cut(entry, "=")
+		if !ok || old == "" || new == "" {
+			return fmt.Errorf("'%s' must be like <old-url>=<new-url>", entry)
+		}
+		calendarUpgradeURLs[normalizeCalendar(old)] = new
+	}
+	return nil
+}
+
+// calendarHeaders are extra http headers sent to some calendars, like api keys for paid ones
+var calendarHeaders = make(map[string]http.Header)
+
+// parseCalendarHeaders reads entries like "https://calendar.example.com=Authorization: Bearer xyz"
+func parseCalendarHeaders(entries []string) error {
+	for _, entry := range entries {
+		calendar, header, _ := strings.Cut(entry, "=")
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || calendar == "" || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("'%s' must be like <calendar-url>=<header>: <value>", entry)
+		}
+		calendar = normalizeCalendar(calendar)
+		if _, ok := calendarHeaders[calendar]; !ok {
+			calendarHeaders[calendar] = make(http.Header)
+		}
+		calendarHeaders[calendar].Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return nil
+}
+
+// calendarHeadersTransport adds CALENDAR_HEADERS to requests going to those calendars, it has to sit
+// in http.DefaultClient since that's what the opentimestamps library uses for stamping and upgrading
+type calendarHeadersTransport struct {
+	base http.RoundTripper
+}
+
+func (t calendarHeadersTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	url := req.URL.String()
+	for calendar, headers := range calendarHeaders {
+		if url != calendar && !strings.HasPrefix(url, calendar+"/") {
+			continue
+		}
+		req = req.Clone(req.Context())
+		for name, values := range headers {
+			for _, value := range values {
+				req.Header.Add(name, value)
+			}
+		}
+		break
+	}
+	return t.base.RoundTrip(req)
+}
+
+// useCalendarHeaders must be called after the proxy is set up, it wraps whatever transport is there
+func useCalendarHeaders() {
+	base := http.DefaultClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	http.DefaultClient.Transport = calendarHeadersTransport{base}
+}
+
+// calendarStatusError is a calendar answering a stamp request with something other than a 200
+type calendarStatusError struct {
+	code int
+}
+
+func (e calendarStatusError) Error() string {
+	return fmt.Sprintf("calendar returned %d", e.code)
+}
+
+// stampStatusTransport turns stamp responses that aren't a 200 into errors, otherwise the opentimestamps
+// library tries to parse the error page and all we get is a parse error
+type stampStatusTransport struct {
+	base http.RoundTripper
+}
+
+func (t stampStatusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || req.Method != "POST" || !strings.HasSuffix(req.URL.Path, "/digest") || resp.StatusCode == http.StatusOK {
+		return resp, err
+	}
+	resp.Body.Close()
+	return nil, calendarStatusError{resp.StatusCode}
+}
+
+// useStampStatus must be called after the proxy and the calendar headers are set up
+func useStampStatus() {
+	base := http.DefaultClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	http.DefaultClient.Transport = stampStatusTransport{base}
+}
+
+// stampErrorType classifies a stamp error as "timeout", "connection", "rejected" (4xx), "server" (5xx)
+// or "invalid" (a response we couldn't parse)
+func stampErrorType(err error) string {
+	var statusErr calendarStatusError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &statusErr) && statusErr.code >= 500:
+		return "server"
+	case errors.As(err, &statusErr):
+		return "rejected"
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return "timeout"
+	case errors.As(err, &netErr):
+		// refused, reset, dns failures
+		return "connection"
+	case strings.Contains(err.Error(), "failed to parse response"):
+		return "invalid"
+	default:
+		return "other"
+	}
+}
+
+// permanentStampError tells if a calendar will keep refusing this digest, so there's no point in retrying.
+// rate limits and timeouts from the calendar are 4xx but are worth waiting for.
+func permanentStampError(err error) bool {
+	var statusErr calendarStatusError
+	return errors.As(err, &statusErr) && statusErr.code >= 400 && statusErr.code < 500 &&
+		statusErr.code != http.StatusTooManyRequests && statusErr.code != http.StatusRequestTimeout
+}
+
+// errStampRefused is what we get when every calendar gave a permanent error for a digest
+var errStampRefused = errors.New("all calendars refused to stamp")
+
+// Timestamper is what talks to the calendars, it's not the library itself so tests can use a fake
+type Timestamper interface {
+	Stamp(ctx context.Context, calendar string, digest [32]byte) (opentimestamps.Sequence, error)
+	UpgradeSequence(ctx context.Context, seq opentimestamps.Sequence, digest []byte) (opentimestamps.Sequence, error)
+}
+
+var timestamper Timestamper = libTimestamper{}
+
+// libTimestamper just calls the opentimestamps library
+type libTimestamper struct{}
+
+func (libTimestamper) Stamp(ctx context.Context, calendar string, digest [32]byte) (opentimestamps.Sequence, error) {
+	return opentimestamps.Stamp(ctx, calendar, digest)
+}
+
+func (libTimestamper) UpgradeSequence(ctx context.Context, seq opentimestamps.Sequence, digest []byte) (opentimestamps.Sequence, error) {
+	return opentimestamps.UpgradeSequence(ctx, seq, digest)
+}
+
+func normalizeCalendar(url string) string {
+	return strings.TrimSuffix(strings.TrimSpace(url), "/")
+}
+
+// upgradeSequence is like opentimestamps.UpgradeSequence but knows about calendars that moved:
+// it uses CALENDAR_UPGRADE_URLS when the sequence points at one of those, and if the sequence
+// points at a calendar we don't use anymore it tries the configured calendars after it fails
+func upgradeSequence(ctx context.Context, seq opentimestamps.Sequence, digest []byte) (opentimestamps.Sequence, error) {
+	calendar := normalizeCalendar(seq.GetAttestation().CalendarServerURL)
+	if url, ok := calendarUpgradeURLs[calendar]; ok {
+		return upgradeSequenceAt(ctx, seq, digest, url)
+	}
+
+	newSeq, err := timestamper.UpgradeSequence(ctx, seq, digest)
+	if err == nil {
+		return newSeq, nil
+	}
+	for _, c := range s.Calendars {
+		if normalizeCalendar(c) == calendar {
+			return nil, err
+		}
+	}
+
+	for _, c := range s.Calendars {
+		if newSeq, ferr := upgradeSequenceAt(ctx, seq, digest, c); ferr == nil {
+			return newSeq, nil
+		}
+	}
+	return nil, err
+}
+
+// upgradeSequenceAt asks the given calendar instead of the one in the sequence's pending attestation
+func upgradeSequenceAt(ctx context.Context, seq opentimestamps.Sequence, digest []byte, url string) (opentimestamps.Sequence, error) {
+	moved := make(opentimestamps.Sequence, len(seq))
+	copy(moved, seq)
+	moved[len(moved)-1] = opentimestamps.Instruction{
+		Attestation: &opentimestamps.Attestation{CalendarServerURL: url},
+	}
+	return timestamper.UpgradeSequence(ctx, moved, digest)
+}
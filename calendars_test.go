@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/nbd-wtf/opentimestamps"
+)
+
+// upgradingTimestamper only upgrades sequences that point at accept, and remembers where it was asked
+type upgradingTimestamper struct {
+	fakeTimestamper
+	accept string
+	asked  []string
+}
+
+func (ut *upgradingTimestamper) UpgradeSequence(ctx context.Context, seq opentimestamps.Sequence, digest []byte) (opentimestamps.Sequence, error) {
+	calendar := seq.GetAttestation().CalendarServerURL
+	ut.asked = append(ut.asked, calendar)
+	if calendar != ut.accept {
+		return nil, errors.New("not found")
+	}
+	return opentimestamps.Sequence{{Attestation: &opentimestamps.Attestation{BitcoinBlockHeight: 800_000}}}, nil
+}
+
+func pendingAt(calendar string) opentimestamps.Sequence {
+	return opentimestamps.Sequence{{Attestation: &opentimestamps.Attestation{CalendarServerURL: calendar}}}
+}
+
+func TestUpgradeSequenceFallsBackToOurCalendars(t *testing.T) {
+	setup(t)
+	s.Calendars = []string{"https://a.example.com", "https://b.example.com"}
+	ut := &upgradingTimestamper{accept: "https://b.example.com"}
+	useTimestamper(t, ut)
+
+	// a calendar we don't use anymore
+	upgraded, err := upgradeSequence(context.Background(), pendingAt("https://gone.example.com"), make([]byte, 32))
+	if err != nil {
+		t.Fatalf("failed to upgrade: %s", err)
+	}
+	if upgraded.GetAttestation().BitcoinBlockHeight != 800_000 {
+		t.Errorf("got %s", upgraded.GetAttestation().Human())
+	}
+	if expected := []string{"https://gone.example.com", "https://a.example.com", "https://b.example.com"}; !reflect.DeepEqual(ut.asked, expected) {
+		t.Errorf("asked %v, expected %v", ut.asked, expected)
+	}
+
+	// a calendar we use, if it doesn't have it the others won't either
+	ut.asked = nil
+	if _, err := upgradeSequence(context.Background(), pendingAt("https://a.example.com"), make([]byte, 32)); err == nil {
+		t.Errorf("upgraded with a calendar it wasn't stamped on")
+	}
+	if len(ut.asked) != 1 {
+		t.Errorf("asked %v, should only ask the calendar in the sequence", ut.asked)
+	}
+}
+
+func TestUpgradeSequenceAtMovedCalendar(t *testing.T) {
+	setup(t)
+	ut := &upgradingTimestamper{accept: "https://new.example.com"}
+	useTimestamper(t, ut)
+	if err := parseCalendarUpgradeURLs([]string{"https://old.example.com=https://new.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { delete(calendarUpgradeURLs, "https://old.example.com") })
+
+	if _, err := upgradeSequence(context.Background(), pendingAt("https://old.example.com/"), make([]byte, 32)); err != nil {
+		t.Fatalf("failed to upgrade: %s", err)
+	}
+	if expected := []string{"https://new.example.com"}; !reflect.DeepEqual(ut.asked, expected) {
+		t.Errorf("asked %v, expected %v", ut.asked, expected)
+	}
+}
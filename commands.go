@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/opentimestamps"
+)
+
+// verify checks the attestation we have for an event -- or the one published on relays -- against bitcoin
+func verify(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: verify <event-id>")
+	}
+	id := args[0]
+	digest, err := hex.DecodeString(id)
+	if err != nil || len(digest) != 32 {
+		return fmt.Errorf("invalid event id '%s'", id)
+	}
+
+	var ots *opentimestamps.File
+	if _, _, data, err := store.Load(id); err == nil && data != nil {
+		if ots, err = opentimestamps.ReadFromFile(data); err != nil {
+			return fmt.Errorf("failed to parse stored ots: %w", err)
+		}
+	} else {
+		ictx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		defer cancel()
+		pool := nostr.NewSimplePool(ictx)
+		ie := pool.QuerySingle(ictx, s.Relays, nostr.Filter{
+			Kinds: []int{1040},
+			Tags:  nostr.TagMap{"e": []string{id}},
+		})
+		if ie == nil {
+			return fmt.Errorf("no attestation found for %s", id)
+		}
+		data, err := base64.StdEncoding.DecodeString(ie.Content)
+		if err != nil {
+			return fmt.Errorf("invalid base64 in attestation %s: %w", ie.ID, err)
+		}
+		if ots, err = opentimestamps.ReadFromFile(data); err != nil {
+			return fmt.Errorf("failed to parse ots from attestation %s: %w", ie.ID, err)
+		}
+	}
+
+	if !bytes.Equal(ots.Digest, digest) {
+		return fmt.Errorf("invalid: attestation digest %x doesn't match event id %s", ots.Digest, id)
+	}
+
+	// if we don't have a bitcoin attestation yet try to get one from the calendars
+	seqs := ots.GetBitcoinAttestedSequences()
+	if len(seqs) == 0 {
+		for _, seq := range ots.GetPendingSequences() {
+			ictx, cancel := context.WithTimeout(ctx, s.UpgradeTimeout)
+			newSeq, err := upgradeSequence(ictx, seq, ots.Digest)
+			cancel()
+			if err == nil {
+				seqs = append(seqs, newSeq)
+			}
+		}
+	}
+	if len(seqs) == 0 {
+		return fmt.Errorf("pending: no bitcoin attestation yet")
+	}
+
+	for _, seq := range seqs {
+		if err = verifyAttestation(ctx, seq, ots.Digest); err != nil {
+			continue
+		}
+
+		height := seq.GetAttestation().BitcoinBlockHeight
+		hash, header, err := blockAt(ctx, height)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("confirmed: block %d (%s) at %s\n", height, hash, header.Timestamp.UTC().Format(time.RFC3339))
+		return nil
+	}
+
+	return fmt.Errorf("invalid: %w", err)
+}
+
+// backfill stamps all the matching events published in a given time window, then exits
+func backfill(ctx context.Context, args []string) error {
+	if s.SecretKey == "" {
+		return fmt.Errorf("SECRET_KEY is required")
+	}
+
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	sinceStr := fs.String("since", "", "start of the time window (2006-01-02, RFC3339 or unix timestamp)")
+	untilStr := fs.String("until", "", "end of the time window, defaults to now")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *sinceStr == "" {
+		return fmt.Errorf("usage: backfill --since <date> [--until <date>]")
+	}
+	since, err := parseDate(*sinceStr)
+	if err != nil {
+		return fmt.Errorf("invalid --since: %w", err)
+	}
+	until := nostr.Now()
+	if *untilStr != "" {
+		if until, err = parseDate(*untilStr); err != nil {
+			return fmt.Errorf("invalid --until: %w", err)
+		}
+	}
+
+	pool := NewRelayPool(ctx)
+	found := 0
+	stamped := 0
+
+	// relays only return so many events per query, so we go backwards from until one page at a time.
+	// events with the same created_at as the oldest one may be split between pages, so each page ends at
+	// that timestamp again and the repeated ones are skipped
+	seen := make(map[string]bool)
+	for until >= since && ctx.Err() == nil {
+		got := 0
+		fresh := 0
+		oldest := until
+		for event := range pool.SubManyEose(ctx, s.Relays, nostr.Filters{
+			{
+				Kinds:   s.Kinds,
+				Authors: allowedList(),
+				Tags:    nostr.TagMap{"t": s.Hashtags},
+				Since:   &since,
+				Until:   &until,
+			},
+		}) {
+			got++
+			if event.CreatedAt < oldest {
+				oldest = event.CreatedAt
+			}
+			if seen[event.ID] {
+				continue
+			}
+			seen[event.ID] = true
+			fresh++
+
+			if ok, _ := event.CheckSignature(); !ok {
+				continue
+			}
+			found++
+			var relays []string
+			if relay := relayURL(event); relay != "" {
+				relays = append(relays, relay)
+			}
+			if handleEvent(ctx, store, pool, *event.Event, relays) {
+				stamped++
+			}
+		}
+
+		if got == 0 {
+			break
+		}
+		if fresh == 0 {
+			// everything at this timestamp was already seen
+			oldest--
+		}
+		until = oldest
+	}
+
+	fmt.Printf("found %d events, stamped %d\n", found, stamped)
+	return ctx.Err()
+}
+
+// republish publishes again the attestation for a stored timestamp that was already upgraded, for when
+// publishing it the first time failed
+func republish(ctx context.Context, args []string) error {
+	if s.SecretKey == "" {
+		return fmt.Errorf("SECRET_KEY is required")
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: republish <event-id>")
+	}
+	id := args[0]
+
+	// a running instance may be publishing it right now
+	unlock, ok := lockID(id)
+	if !ok {
+		return fmt.Errorf("%s is being published by a running instance, try again later", id)
+	}
+	defer unlock()
+
+	// if it was already published just send the same attestation to the relays that don't have it
+	if attestation, done, err := store.LoadPublished(id); err == nil {
+		return resendPublished(ctx, id, attestation, done)
+	}
+
+	event, relays, data, err := store.Load(id)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return fmt.Errorf("%s was never stamped", id)
+	}
+	ots, err := opentimestamps.ReadFromFile(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse stored ots: %w", err)
+	}
+	seqs := ots.GetBitcoinAttestedSequences()
+	if len(seqs) == 0 {
+		return fmt.Errorf("pending: no bitcoin attestation yet")
+	}
+	if err := verifyAttestation(ctx, seqs[0], ots.Digest); err != nil {
+		return fmt.Errorf("invalid: %w", err)
+	}
+
+	blockHeight, blockHash, err := getTip(ctx)
+	if err != nil {
+		return err
+	}
+	eventRelay := bestRelay(relays)
+	attestation, err := attestationEvent(ctx, event, eventRelay, ots.Digest, seqs[0], blockHeight, blockHash)
+	if err != nil {
+		return err
+	}
+
+	pool := NewRelayPool(ctx)
+	relays = publishRelays(eventRelay, relays)
+	published := publishToRelays(ctx, pool, attestation, relays)
+	if len(published) == 0 {
+		return fmt.Errorf("failed to publish to any relay")
+	}
+	if s.PublishAddressable {
+		publishAddressable(ctx, pool, attestation, relays)
+	}
+	if err := store.SavePublished(id, attestation, published); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to record published attestation: %s\n", err)
+	}
+
+	if err := store.Delete(id); err != nil {
+		return fmt.Errorf("published, but failed to delete: %w", err)
+	}
+	fmt.Printf("published %s to %s\n", attestation.ID, strings.Join(published, ", "))
+	return nil
+}
+
+// resendPublished publishes an attestation we published before to the relays that don't have it yet
+func resendPublished(ctx context.Context, id string, attestation nostr.Event, done []string) error {
+	have := make(map[string]bool, len(done))
+	for _, url := range done {
+		have[nostr.NormalizeURL(url)] = true
+	}
+	eventRelay := ""
+	if e := attestation.Tags.GetFirst([]string{"e", ""}); e != nil && len(*e) > 2 {
+		eventRelay = (*e)[2]
+	}
+	relays := publishRelays(eventRelay, nil)
+	missing := make([]string, 0, len(relays))
+	for _, url := range relays {
+		if url != "" && !have[nostr.NormalizeURL(url)] {
+			missing = append(missing, url)
+		}
+	}
+	if len(missing) == 0 {
+		fmt.Printf("%s is already on all relays\n", attestation.ID)
+		return nil
+	}
+
+	published := publishToRelays(ctx, NewRelayPool(ctx), attestation, missing)
+	if len(published) == 0 {
+		return fmt.Errorf("failed to publish to any relay")
+	}
+	if err := store.SavePublished(id, attestation, append(done, published...)); err != nil {
+		return fmt.Errorf("published, but failed to record it: %w", err)
+	}
+	fmt.Printf("published %s to %s\n", attestation.ID, strings.Join(published, ", "))
+	return nil
+}
+
+func parseDate(str string) (nostr.Timestamp, error) {
+	if ts, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return nostr.Timestamp(ts), nil
+	}
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return nostr.Timestamp(t.Unix()), nil
+	}
+	t, err := time.Parse("2006-01-02", str)
+	if err != nil {
+		return 0, err
+	}
+	return nostr.Timestamp(t.Unix()), nil
+}
+
+// list shows the timestamps that are still pending
+func list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print as json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ids, err := store.PendingIDs()
+	if err != nil {
+		return err
+	}
+
+	type entry struct {
+		ID        string    `json:"id"`
+		StampedAt time.Time `json:"stamped_at"`
+		Age       string    `json:"age"`
+		Bitcoin   bool      `json:"bitcoin"`
+	}
+	entries := make([]entry, 0, len(ids))
+	for _, id := range ids {
+		e := entry{ID: id}
+		if stampedAt, err := store.StampedAt(id); err == nil {
+			e.StampedAt = stampedAt
+			e.Age = time.Since(stampedAt).Truncate(time.Second).String()
+		}
+		if _, _, data, err := store.Load(id); err == nil {
+			if ots, err := opentimestamps.ReadFromFile(data); err == nil {
+				e.Bitcoin = len(ots.GetBitcoinAttestedSequences()) > 0
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(entries)
+	}
+	for _, e := range entries {
+		status := "pending"
+		if e.Bitcoin {
+			status = "bitcoin"
+		}
+		fmt.Printf("%s  %-8s  %s\n", e.ID, status, e.Age)
+	}
+	return nil
+}
+
+// migrate converts the stamps kept in the three-files format to the single json file format
+func migrate(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: migrate")
+	}
+
+	from := FileStore{dir: s.DataDir}
+	to := JSONStore{dir: s.DataDir}
+
+	pending, err := from.PendingIDs()
+	if err != nil {
+		return err
+	}
+	unstamped, err := from.UnstampedIDs()
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for _, id := range append(pending, unstamped...) {
+		event, relays, ots, err := from.Load(id)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", id, err)
+		}
+		record := stampRecord{Event: event, Relays: relays, OTS: ots}
+		if stampedAt, err := from.StampedAt(id); err == nil {
+			record.StampedAt = stampedAt.Unix()
+		}
+		if record.StampAttempts, err = from.stampAttempts(id); err != nil {
+			return fmt.Errorf("failed to read stamp attempts for %s: %w", id, err)
+		}
+		record.PendingNote, _ = from.PendingNote(id)
+
+		if err := to.write(id, record); err != nil {
+			return fmt.Errorf("failed to write %s: %w", id, err)
+		}
+		from.Delete(id)
+		migrated++
+	}
+
+	fmt.Printf("migrated %d stamps, now run with STORAGE=json\n", migrated)
+	return nil
+}
+
+// export writes the proof we have for an event as a standard .ots file, upgrading it first if we can,
+// so it can be checked with `ots verify -d <event-id> <outfile>`
+func export(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: export <event-id> <outfile>")
+	}
+	id, outfile := args[0], args[1]
+
+	_, _, data, err := store.Load(id)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return fmt.Errorf("%s was never stamped", id)
+	}
+	ots, err := opentimestamps.ReadFromFile(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse stored ots: %w", err)
+	}
+
+	if len(ots.GetBitcoinAttestedSequences()) == 0 {
+		for i, seq := range ots.Sequences {
+			ictx, cancel := context.WithTimeout(ctx, s.UpgradeTimeout)
+			upgraded, err := upgradeSequence(ictx, seq, ots.Digest)
+			cancel()
+			if err != nil {
+				continue
+			}
+			ots.Sequences[i] = upgraded
+		}
+	}
+
+	if err := os.WriteFile(outfile, ots.SerializeToFile(), 0644); err != nil {
+		return err
+	}
+	status := "pending"
+	if seqs := ots.GetBitcoinAttestedSequences(); len(seqs) > 0 {
+		status = fmt.Sprintf("confirmed in block %d", seqs[0].GetAttestation().BitcoinBlockHeight)
+	}
+	fmt.Printf("wrote %s (%s)\n", outfile, status)
+	return nil
+}
+
+// doctor checks everything the bot needs with the real config and prints what works and what doesn't
+func doctor(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: doctor")
+	}
+
+	failed := 0
+	check := func(name string, err error) {
+		if err != nil {
+			fmt.Printf("FAIL  %s: %s\n", name, err)
+			failed++
+		} else {
+			fmt.Printf("ok    %s\n", name)
+		}
+	}
+
+	// SECRET_KEY was already validated when reading the config, it can only be missing here
+	if s.SecretKey == "" {
+		check("secret key", fmt.Errorf("SECRET_KEY is not set"))
+	} else {
+		check("secret key ("+botPubkey+")", nil)
+	}
+
+	// a throwaway digest, calendars will stamp anything
+	var digest [32]byte
+	rand.Read(digest[:])
+	for _, calendar := range s.Calendars {
+		ictx, cancel := context.WithTimeout(ctx, s.StampTimeout)
+		_, err := timestamper.Stamp(ictx, calendar, digest)
+		cancel()
+		check("calendar "+calendar, err)
+	}
+
+	checkTip := func(name string, source BlockSource) {
+		ictx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		defer cancel()
+		height, _, err := source.Tip(ictx)
+		if err == nil {
+			name += fmt.Sprintf(" (block %d)", height)
+		}
+		check(name, err)
+	}
+	if es, ok := blockSource.(esploras); ok {
+		for _, base := range es {
+			checkTip("esplora "+base, esploras{base})
+		}
+	} else {
+		checkTip("bitcoin rpc", blockSource)
+	}
+
+	pool := NewRelayPool(ctx)
+	for _, url := range s.Relays {
+		check("relay "+url, checkRelay(ctx, pool, url))
+	}
+
+	if f, err := os.CreateTemp(s.DataDir, ".doctor-"); err != nil {
+		check("data dir "+s.DataDir, err)
+	} else {
+		f.Close()
+		check("data dir "+s.DataDir, os.Remove(f.Name()))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// checkRelay connects to the relay and waits for the EOSE of a small subscription
+func checkRelay(ctx context.Context, pool *RelayPool, url string) error {
+	relay, err := pool.EnsureRelay(url)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	sub, err := relay.Subscribe(ctx, nostr.Filters{{Kinds: s.Kinds, Limit: 1}})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsub()
+	select {
+	case <-sub.EndOfStoredEvents:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("no EOSE after 15s")
+	}
+}
+
+// prune finds the files of stamps that can't be used anymore in DATA_DIR: an ots or relay list without its
+// event, an event without its relay list, and temporary files left by interrupted writes.
+// it only reports them unless --delete is given.
+func prune(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	del := fs.Bool("delete", false, "delete the files instead of just listing them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if s.Storage != "files" {
+		return fmt.Errorf("prune only works with STORAGE=files")
+	}
+
+	entries, err := os.ReadDir(s.DataDir)
+	if err != nil {
+		return err
+	}
+
+	// the files of each id by prefix, leaving out the published records and summaries which are kept on purpose
+	kinds := [][2]string{
+		{PREFIX_EVENT, SUFFIX_EVENT},
+		{PREFIX_RELAY, SUFFIX_RELAY},
+		{PREFIX_OTS, SUFFIX_OTS},
+		{PREFIX_ATTEMPTS, SUFFIX_ATTEMPTS},
+		{PREFIX_NOTE, SUFFIX_NOTE},
+	}
+	files := make(map[string]map[string]string)
+	newest := make(map[string]time.Time)
+	orphans := make(map[string]string) // file name -> reason
+	for _, entry := range entries {
+		name := entry.Name()
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() {
+			continue
+		}
+
+		if strings.HasSuffix(name, ".tmp") {
+			// a recent one may be a write that is still going on
+			if time.Since(info.ModTime()) >= PRUNE_MIN_AGE {
+				orphans[name] = "interrupted write"
+			}
+			continue
+		}
+		for _, kind := range kinds {
+			if strings.HasPrefix(name, kind[0]) && strings.HasSuffix(name, kind[1]) {
+				id := name[len(kind[0]) : len(name)-len(kind[1])]
+				if files[id] == nil {
+					files[id] = make(map[string]string)
+				}
+				files[id][kind[0]] = name
+				if info.ModTime().After(newest[id]) {
+					newest[id] = info.ModTime()
+				}
+				break
+			}
+		}
+	}
+
+	for id, set := range files {
+		// a set with a recent file may still be being written, the ots keeps its old modification time when
+		// it's updated so only the newest file of the set tells
+		if time.Since(newest[id]) < PRUNE_MIN_AGE {
+			continue
+		}
+
+		reason := ""
+		if _, ok := set[PREFIX_EVENT]; !ok {
+			reason = "no event"
+		} else if _, ok := set[PREFIX_RELAY]; !ok {
+			reason = "no relay list"
+		}
+		if reason == "" {
+			continue
+		}
+		for _, name := range set {
+			orphans[name] = reason
+		}
+	}
+
+	if len(orphans) == 0 {
+		fmt.Println("nothing to prune")
+		return nil
+	}
+	names := make([]string, 0, len(orphans))
+	for name := range orphans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s  %s\n", name, orphans[name])
+	}
+
+	if !*del {
+		fmt.Printf("%d files can be pruned, run with --delete to delete them\n", len(orphans))
+		return nil
+	}
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(s.DataDir, name)); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("deleted %d files\n", len(orphans))
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestBackfill(t *testing.T) {
+	h := newHarness(t)
+	s.SkipExisting = false
+
+	now := nostr.Now()
+	var events []nostr.Event
+	for i, age := range []nostr.Timestamp{10, 20, 30, 40} {
+		event := nostr.Event{CreatedAt: now - age, Kind: 1, Tags: nostr.Tags{{"t", "prediction"}}, Content: fmt.Sprint(i)}
+		event.Sign(nostr.GeneratePrivateKey())
+		events = append(events, event)
+	}
+	h.relay.add(events...)
+
+	args := []string{"--since", fmt.Sprint(now - 35), "--until", fmt.Sprint(now - 15)}
+	if err := backfill(h.ctx, args); err != nil {
+		t.Fatalf("backfill failed: %s", err)
+	}
+	for i, event := range events {
+		if stamped := store.HasStamp(event.ID); stamped != (i == 1 || i == 2) {
+			t.Errorf("event %d created %ds ago: stamped=%v", i, now-event.CreatedAt, stamped)
+		}
+	}
+
+	// running it again doesn't stamp anything new
+	if err := backfill(h.ctx, args); err != nil {
+		t.Fatalf("backfill failed the second time: %s", err)
+	}
+	if n := h.calendar.stampCount(); n != 2 {
+		t.Errorf("expected 2 stamps, got %d", n)
+	}
+}
+
+func TestBackfillPages(t *testing.T) {
+	h := newHarness(t)
+	s.SkipExisting = false
+	useTimestamper(t, &fakeTimestamper{})
+
+	// the relay only returns 2 events per query, and the two at -20 end up on different pages
+	h.relay.limit = 2
+	now := nostr.Now()
+	var events []nostr.Event
+	for i, age := range []nostr.Timestamp{10, 20, 20, 30, 40, 50} {
+		event := nostr.Event{CreatedAt: now - age, Kind: 1, Tags: nostr.Tags{{"t", "prediction"}}, Content: fmt.Sprint(i)}
+		event.Sign(nostr.GeneratePrivateKey())
+		events = append(events, event)
+	}
+	h.relay.add(events...)
+
+	if err := backfill(h.ctx, []string{"--since", fmt.Sprint(now - 45)}); err != nil {
+		t.Fatalf("backfill failed: %s", err)
+	}
+
+	for i, event := range events {
+		if stamped := store.HasStamp(event.ID); stamped != (i < 5) {
+			t.Errorf("event %d created %ds ago: stamped=%v", i, now-event.CreatedAt, stamped)
+		}
+	}
+}
+
+func TestPruneKeepsSetBeingWritten(t *testing.T) {
+	setup(t)
+	old := time.Now().Add(-2 * PRUNE_MIN_AGE)
+
+	write := func(name string, at time.Time) {
+		path := filepath.Join(s.DataDir, name)
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// being saved again right now: the event was just rewritten, the relay file isn't there yet and
+	// the ots kept its old modification time
+	live := "aa"
+	write(PREFIX_EVENT+live+SUFFIX_EVENT, time.Now())
+	write(PREFIX_OTS+live+SUFFIX_OTS, old)
+
+	// left behind a long time ago
+	orphan := "bb"
+	write(PREFIX_OTS+orphan+SUFFIX_OTS, old)
+	write(PREFIX_ATTEMPTS+orphan+SUFFIX_ATTEMPTS, old)
+
+	// a write that is still going on and one that was interrupted
+	write(PREFIX_EVENT+"cc"+SUFFIX_EVENT+".123.tmp", time.Now())
+	write(PREFIX_EVENT+"dd"+SUFFIX_EVENT+".456.tmp", old)
+
+	if err := prune([]string{"--delete"}); err != nil {
+		t.Fatalf("prune failed: %s", err)
+	}
+
+	for name, kept := range map[string]bool{
+		PREFIX_EVENT + live + SUFFIX_EVENT:              true,
+		PREFIX_OTS + live + SUFFIX_OTS:                  true,
+		PREFIX_OTS + orphan + SUFFIX_OTS:                false,
+		PREFIX_ATTEMPTS + orphan + SUFFIX_ATTEMPTS:      false,
+		PREFIX_EVENT + "cc" + SUFFIX_EVENT + ".123.tmp": true,
+		PREFIX_EVENT + "dd" + SUFFIX_EVENT + ".456.tmp": false,
+	} {
+		_, err := os.Stat(filepath.Join(s.DataDir, name))
+		if exists := err == nil; exists != kept {
+			t.Errorf("%s: exists=%v, expected %v", name, exists, kept)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfigFile reads a yaml file that uses the same names as the environment variables, like
+//
+//	RELAYS: [wss://nostr.mom, wss://nostr.wine]
+//	UPGRADE_INTERVAL: 30m
+//
+// and sets the ones that aren't already in the environment, so environment variables always win
+func loadConfigFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return err
+	}
+
+	known := settingNames()
+	for key, value := range values {
+		key = strings.ToUpper(key)
+		if !known[key] {
+			return fmt.Errorf("unknown setting '%s'", key)
+		}
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		str, err := configValue(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		os.Setenv(key, str)
+	}
+	return nil
+}
+
+// configValue turns a yaml value into what envconfig expects, lists are comma-separated
+func configValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			str, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = str
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		return "", fmt.Errorf("must be a value or a list")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// settingNames are the environment variables Settings reads
+func settingNames() map[string]bool {
+	t := reflect.TypeOf(Settings{})
+	names := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("envconfig"); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/opentimestamps"
+)
+
+const DEFAULT_CONFIRMATION_TEMPLATE = "timestamp confirmed in block {{.BlockHeight}} at {{.BlockTime}}\n\nblock hash: {{.BlockHash}}"
+
+var confirmationTemplate *template.Template
+
+// confirmationData is what can be used in CONFIRMATION_TEMPLATE
+type confirmationData struct {
+	EventID     string
+	Pubkey      string
+	BlockHeight uint64
+	BlockHash   string
+	BlockTime   string // RFC3339, in UTC
+}
+
+// parseConfirmationTemplate fails early on templates that don't parse or that use fields we don't have
+func parseConfirmationTemplate(text string) error {
+	tmpl, err := template.New("confirmation").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return err
+	}
+	if err := tmpl.Execute(io.Discard, confirmationData{}); err != nil {
+		return err
+	}
+	confirmationTemplate = tmpl
+	return nil
+}
+
+const PENDING_NOTE = "timestamp submitted to the calendars, waiting for a bitcoin block"
+
+// postPendingNote replies to the prediction saying it was stamped and remembers the note so it can be deleted later
+func postPendingNote(ctx context.Context, store StampStore, pool *RelayPool, target nostr.Event, targetRelay string, relays []string) {
+	note, published, err := postReply(ctx, pool, target, targetRelay, PENDING_NOTE, relays)
+	if err != nil {
+		slog.Warn("failed to post pending note", "event_id", target.ID, "error", err)
+		return
+	}
+	slog.Info("published pending note", "event_id", target.ID, "note_id", note.ID, "relays", published)
+	if err := store.SavePendingNote(target.ID, note.ID); err != nil {
+		slog.Warn("failed to record pending note", "event_id", target.ID, "note_id", note.ID, "error", err)
+	}
+}
+
+// postConfirmationNote replies to the prediction with a human-readable note saying where it was confirmed,
+// then deletes the pending note if we posted one for the stamp under id
+func postConfirmationNote(ctx context.Context, store StampStore, pool *RelayPool, id string, target nostr.Event, targetRelay string, seq opentimestamps.Sequence, relays []string) {
+	height := seq.GetAttestation().BitcoinBlockHeight
+	hash, header, err := blockAt(ctx, height)
+	if err != nil {
+		slog.Warn("failed to get block for confirmation note", "event_id", target.ID, "block_height", height, "error", err)
+		return
+	}
+
+	content := strings.Builder{}
+	if err := confirmationTemplate.Execute(&content, confirmationData{
+		EventID:     target.ID,
+		Pubkey:      target.PubKey,
+		BlockHeight: height,
+		BlockHash:   hash.String(),
+		BlockTime:   header.Timestamp.UTC().Format(time.RFC3339),
+	}); err != nil {
+		slog.Error("failed to render confirmation note", "event_id", target.ID, "error", err)
+		return
+	}
+
+	note, published, err := postReply(ctx, pool, target, targetRelay, content.String(), relays)
+	if err != nil {
+		slog.Warn("failed to post confirmation note", "event_id", target.ID, "error", err)
+		return
+	}
+	slog.Info("published confirmation note", "event_id", target.ID, "note_id", note.ID, "relays", published)
+
+	if pending, err := store.PendingNote(id); err == nil && pending != "" {
+		deletePendingNote(ctx, pool, target, pending, relays)
+	}
+}
+
+// deletePendingNote asks relays to delete the pending note (NIP-09) so clients don't keep showing it
+func deletePendingNote(ctx context.Context, pool *RelayPool, target nostr.Event, noteID string, relays []string) {
+	deletion := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      5,
+		Content:   "timestamp confirmed",
+		Tags:      nostr.Tags{nostr.Tag{"e", noteID}},
+	}
+	if err := deletion.Sign(s.SecretKey); err != nil {
+		slog.Error("failed to sign pending note deletion", "event_id", target.ID, "error", err)
+		return
+	}
+	if published := publishToRelays(ctx, pool, deletion, relays); len(published) == 0 {
+		slog.Warn("failed to delete pending note", "event_id", target.ID, "note_id", noteID)
+		return
+	}
+	slog.Info("deleted pending note", "event_id", target.ID, "note_id", noteID)
+}
+
+// postReply publishes a kind-1 reply to target and returns it with the relays that accepted it
+func postReply(ctx context.Context, pool *RelayPool, target nostr.Event, targetRelay string, content string, relays []string) (nostr.Event, []string, error) {
+	note := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      1,
+		Content:   content,
+		Tags: nostr.Tags{
+			nostr.Tag{"e", target.ID, targetRelay, "root"},
+			nostr.Tag{"p", target.PubKey},
+		},
+	}
+	if err := note.Sign(s.SecretKey); err != nil {
+		return note, nil, fmt.Errorf("failed to sign: %w", err)
+	}
+
+	published := publishToRelays(ctx, pool, note, relays)
+	if len(published) == 0 {
+		return note, nil, fmt.Errorf("failed to publish to any relay")
+	}
+	return note, published, nil
+}
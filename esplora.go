@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/nbd-wtf/opentimestamps"
+)
+
+// the highest tip we've seen, new ones can't be too far from it
+var highestTip struct {
+	sync.Mutex
+	height uint64
+}
+
+// getTip fetches the current block height and hash from the block source
+func getTip(ctx context.Context) (height uint64, hash string, err error) {
+	if height, hash, err = blockSource.Tip(ctx); err != nil {
+		return 0, "", err
+	}
+
+	highestTip.Lock()
+	highestTip.height = max(highestTip.height, height)
+	highestTip.Unlock()
+	return height, hash, nil
+}
+
+// Tip tries each of the esplora endpoints in order
+func (es esploras) Tip(ctx context.Context) (height uint64, hash string, err error) {
+	for _, base := range es {
+		base = strings.TrimSuffix(base, "/")
+
+		var res string
+		if res, err = esploraGet(ctx, base+"/blocks/tip/height"); err != nil {
+			slog.Warn("error getting block height", "esplora", base, "error", err)
+			continue
+		}
+		if height, err = checkTipHeight(res); err != nil {
+			slog.Warn("error getting block height", "esplora", base, "error", err)
+			continue
+		}
+		if hash, err = esploraGet(ctx, base+"/blocks/tip/hash"); err != nil {
+			slog.Warn("error getting block hash", "esplora", base, "error", err)
+			continue
+		}
+		if b, herr := hex.DecodeString(hash); herr != nil || len(b) != 32 {
+			err = fmt.Errorf("invalid block hash '%s'", hash)
+			slog.Warn("error getting block hash", "esplora", base, "error", err)
+			continue
+		}
+
+		slog.Debug("got tip", "esplora", base, "block_height", height, "block_hash", hash)
+		return height, hash, nil
+	}
+
+	return 0, "", fmt.Errorf("all esplora endpoints failed, last error: %w", err)
+}
+
+// checkTipHeight parses a tip height and rejects the ones that don't make sense given the ones we've seen
+// before: only small reorgs can take it back and it can't jump too far ahead of what we've seen
+func checkTipHeight(res string) (uint64, error) {
+	height, err := strconv.ParseUint(res, 10, 64)
+	if err != nil || height == 0 || height > MAX_BLOCK_HEIGHT {
+		return 0, fmt.Errorf("invalid block height '%s'", res)
+	}
+
+	highestTip.Lock()
+	highest := highestTip.height
+	highestTip.Unlock()
+	if highest > 0 && (height+MAX_TIP_REORG < highest || height > highest+MAX_TIP_JUMP) {
+		return 0, fmt.Errorf("block height %d is too far from the %d we've seen before", height, highest)
+	}
+	return height, nil
+}
+
+func esploraGet(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// errors often come as html pages from whatever is in front of esplora
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return "", fmt.Errorf("%s returned html", url)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", fmt.Errorf("error reading response: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// BlockSource is where we get bitcoin blocks from
+type BlockSource interface {
+	Tip(ctx context.Context) (height uint64, hash string, err error)
+	GetBlockHash(ctx context.Context, height int64) (*chainhash.Hash, error)
+	GetBlockHeader(ctx context.Context, hash *chainhash.Hash) (*wire.BlockHeader, error)
+}
+
+// esplora by default, a bitcoin node when BITCOIN_RPC is set
+var blockSource BlockSource = esploras{"https://blockstream.info/api", "https://mempool.space/api"}
+
+// esploras does what opentimestamps.NewEsploraClient does, but can be canceled and falls back through all
+// the configured endpoints
+type esploras []string
+
+var _ BlockSource = esploras{}
+
+// so ESPLORA can just say which explorer to use
+var esploraProviders = map[string]string{
+	"blockstream":         "https://blockstream.info/api",
+	"blockstream-testnet": "https://blockstream.info/testnet/api",
+	"mempool":             "https://mempool.space/api",
+	"mempool-testnet":     "https://mempool.space/testnet/api",
+	"mempool-signet":      "https://mempool.space/signet/api",
+}
+
+// parseEsploras turns provider names into their api urls and fixes the urls of known explorers that
+// were given without the /api part, which is where they serve the api instead of the website
+func parseEsploras(entries []string) (esploras, error) {
+	es := make(esploras, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSuffix(strings.TrimSpace(entry), "/")
+		if entry == "" {
+			continue
+		}
+		if base, ok := esploraProviders[strings.ToLower(entry)]; ok {
+			es = append(es, base)
+			continue
+		}
+
+		u, err := url.Parse(entry)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("'%s' is not a url or one of the known providers", entry)
+		}
+		if (u.Host == "mempool.space" || u.Host == "blockstream.info") && !strings.HasSuffix(u.Path, "/api") {
+			u.Path += "/api"
+		}
+		es = append(es, u.String())
+	}
+	if len(es) == 0 {
+		return nil, fmt.Errorf("no endpoints")
+	}
+	return es, nil
+}
+
+// checkBlockSource fetches the tip once so we find out right away if the block source is misconfigured,
+// with esplora every endpoint is checked but only all of them failing is an error
+func checkBlockSource(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	es, ok := blockSource.(esploras)
+	if !ok {
+		height, hash, err := blockSource.Tip(ctx)
+		if err != nil {
+			return err
+		}
+		slog.Info("block source is working", "block_height", height, "block_hash", hash)
+		return nil
+	}
+
+	working := 0
+	for _, base := range es {
+		if height, hash, err := (esploras{base}).Tip(ctx); err == nil {
+			slog.Info("esplora is working", "esplora", base, "block_height", height, "block_hash", hash)
+			working++
+		}
+	}
+	if working == 0 {
+		return fmt.Errorf("none of the esplora endpoints are working")
+	}
+	return nil
+}
+
+func (es esploras) GetBlockHash(ctx context.Context, height int64) (hash *chainhash.Hash, err error) {
+	for _, base := range es {
+		var res string
+		if res, err = esploraGet(ctx, strings.TrimSuffix(base, "/")+"/block-height/"+strconv.FormatInt(height, 10)); err != nil {
+			continue
+		}
+		if hash, err = chainhash.NewHashFromStr(strings.TrimSpace(res)); err == nil {
+			return hash, nil
+		}
+	}
+	return nil, err
+}
+
+func (es esploras) GetBlockHeader(ctx context.Context, hash *chainhash.Hash) (header *wire.BlockHeader, err error) {
+	for _, base := range es {
+		var res string
+		if res, err = esploraGet(ctx, strings.TrimSuffix(base, "/")+"/block/"+hash.String()+"/header"); err != nil {
+			continue
+		}
+		var raw []byte
+		if raw, err = hex.DecodeString(strings.TrimSpace(res)); err != nil {
+			continue
+		}
+		header = &wire.BlockHeader{}
+		if err = header.Deserialize(bytes.NewReader(raw)); err == nil {
+			return header, nil
+		}
+	}
+	return nil, err
+}
+
+// headers we've already fetched, many timestamps end up in the same block.
+// the hash at a height can change in a reorg, so heights are only kept for blocks that are buried deep enough.
+// both are capped at BLOCK_CACHE_SIZE, the oldest entries go first.
+var blockCache = struct {
+	sync.Mutex
+	headers map[chainhash.Hash]*wire.BlockHeader
+	hashes  map[uint64]*chainhash.Hash
+	order   []chainhash.Hash
+	heights []uint64
+}{headers: make(map[chainhash.Hash]*wire.BlockHeader), hashes: make(map[uint64]*chainhash.Hash)}
+
+// blockAt fetches the hash and the header of the block at the given height
+func blockAt(ctx context.Context, height uint64) (*chainhash.Hash, *wire.BlockHeader, error) {
+	blockCache.Lock()
+	hash, ok := blockCache.hashes[height]
+	blockCache.Unlock()
+	if !ok {
+		var err error
+		if hash, err = blockSource.GetBlockHash(ctx, int64(height)); err != nil {
+			return nil, nil, fmt.Errorf("failed to get block %d: %w", height, err)
+		}
+	}
+
+	blockCache.Lock()
+	header, ok := blockCache.headers[*hash]
+	blockCache.Unlock()
+	if !ok {
+		var err error
+		if header, err = blockSource.GetBlockHeader(ctx, hash); err != nil {
+			return nil, nil, fmt.Errorf("failed to get block %s header: %w", hash, err)
+		}
+	}
+
+	highestTip.Lock()
+	buried := height+MAX_TIP_REORG <= highestTip.height
+	highestTip.Unlock()
+
+	blockCache.Lock()
+	if _, ok := blockCache.headers[*hash]; !ok {
+		blockCache.headers[*hash] = header
+		blockCache.order = append(blockCache.order, *hash)
+		if len(blockCache.order) > BLOCK_CACHE_SIZE {
+			delete(blockCache.headers, blockCache.order[0])
+			blockCache.order = blockCache.order[1:]
+		}
+	}
+	if _, ok := blockCache.hashes[height]; !ok && buried {
+		blockCache.hashes[height] = hash
+		blockCache.heights = append(blockCache.heights, height)
+		if len(blockCache.heights) > BLOCK_CACHE_SIZE {
+			delete(blockCache.hashes, blockCache.heights[0])
+			blockCache.heights = blockCache.heights[1:]
+		}
+	}
+	blockCache.Unlock()
+	return hash, header, nil
+}
+
+// verifyAttestation checks that the operations in seq take digest to the merkle root of the block it points to,
+// so we never vouch for a timestamp a calendar made up
+func verifyAttestation(ctx context.Context, seq opentimestamps.Sequence, digest []byte) error {
+	height := seq.GetAttestation().BitcoinBlockHeight
+	if height == 0 {
+		return fmt.Errorf("sequence doesn't include a bitcoin attestation")
+	}
+	_, header, err := blockAt(ctx, height)
+	if err != nil {
+		return err
+	}
+	if result := seq.Compute(digest); !bytes.Equal(result, header.MerkleRoot[:]) {
+		return fmt.Errorf("result %x doesn't match the merkle root of block %d: %x", result, height, header.MerkleRoot[:])
+	}
+	return nil
+}
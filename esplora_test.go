@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func TestBlockAtAfterReorg(t *testing.T) {
+	setup(t)
+	me := newMockEsplora(t, 800_000)
+	useEsplora(t, me)
+	if _, _, err := getTip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	before, _, err := blockAt(context.Background(), 800_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := me.setBlock(800_000, chainhash.Hash{0xff})
+	hash, header, err := blockAt(context.Background(), 800_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *hash == *before || *hash != *after {
+		t.Errorf("got block %s, expected %s after the reorg", hash, after)
+	}
+	if header.MerkleRoot != (chainhash.Hash{0xff}) {
+		t.Errorf("got the header from before the reorg")
+	}
+
+	// buried blocks don't need to be looked up again
+	blockAt(context.Background(), 800_000-MAX_TIP_REORG)
+	me.mu.Lock()
+	calls := me.hashCalls
+	me.mu.Unlock()
+	blockAt(context.Background(), 800_000-MAX_TIP_REORG)
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.hashCalls != calls {
+		t.Errorf("hash of a buried block was fetched again")
+	}
+}
+
+func TestBlockCacheIsCapped(t *testing.T) {
+	setup(t)
+	me := newMockEsplora(t, BLOCK_CACHE_SIZE+100)
+	for height := uint64(1); height < BLOCK_CACHE_SIZE+100; height++ {
+		me.setBlock(height, chainhash.Hash{byte(height)})
+	}
+	useEsplora(t, me)
+	if _, _, err := getTip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for height := uint64(1); height <= BLOCK_CACHE_SIZE+100; height++ {
+		if _, _, err := blockAt(context.Background(), height); err != nil {
+			t.Fatalf("block %d: %s", height, err)
+		}
+	}
+
+	blockCache.Lock()
+	defer blockCache.Unlock()
+	if len(blockCache.headers) > BLOCK_CACHE_SIZE || len(blockCache.hashes) > BLOCK_CACHE_SIZE {
+		t.Errorf("cache has %d headers and %d heights, limit is %d",
+			len(blockCache.headers), len(blockCache.hashes), BLOCK_CACHE_SIZE)
+	}
+}
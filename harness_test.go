@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/opentimestamps"
+)
+
+// mockCalendar is an opentimestamps calendar: it commits to each digest it gets with a nonce and, after confirm,
+// answers upgrades with the path from that commitment to the merkle root of a block.
+// if complete is set digests come back already attested in that block instead.
+type mockCalendar struct {
+	url      string
+	complete uint64
+
+	mu           sync.Mutex
+	stamps       int
+	upgradeCalls int
+	commitments  [][]byte
+	upgrades     map[string]opentimestamps.Sequence // by hex commitment
+}
+
+func newMockCalendar(t *testing.T) *mockCalendar {
+	mc := &mockCalendar{upgrades: make(map[string]opentimestamps.Sequence)}
+	server := httptest.NewServer(http.HandlerFunc(mc.serve))
+	t.Cleanup(server.Close)
+	mc.url = server.URL
+	return mc
+}
+
+func (mc *mockCalendar) serve(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/digest":
+		digest, _ := io.ReadAll(r.Body)
+		if len(digest) != 32 {
+			http.Error(w, "invalid digest", http.StatusBadRequest)
+			return
+		}
+		if mc.complete != 0 {
+			mc.mu.Lock()
+			mc.stamps++
+			mc.mu.Unlock()
+			w.Write(serializeSequence(opentimestamps.Sequence{
+				{Attestation: &opentimestamps.Attestation{BitcoinBlockHeight: mc.complete}},
+			}))
+			return
+		}
+		nonce := make([]byte, 16)
+		rand.Read(nonce)
+		commitment := sha256.Sum256(append(digest, nonce...))
+
+		mc.mu.Lock()
+		mc.stamps++
+		mc.commitments = append(mc.commitments, commitment[:])
+		mc.mu.Unlock()
+
+		w.Write(serializeSequence(opentimestamps.Sequence{
+			{Operation: opAppend, Argument: nonce},
+			{Operation: opSHA256},
+			{Attestation: &opentimestamps.Attestation{CalendarServerURL: mc.url}},
+		}))
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/timestamp/"):
+		mc.mu.Lock()
+		mc.upgradeCalls++
+		upgrade, ok := mc.upgrades[strings.TrimPrefix(r.URL.Path, "/timestamp/")]
+		mc.mu.Unlock()
+		if !ok {
+			http.Error(w, "Pending confirmation in Bitcoin blockchain", http.StatusNotFound)
+			return
+		}
+		w.Write(serializeSequence(upgrade))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// confirm puts everything stamped so far in a block at height, sha256 of all the commitments together
+// is its merkle root
+func (mc *mockCalendar) confirm(me *mockEsplora, height uint64) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	all := bytes.Join(mc.commitments, nil)
+	for i, commitment := range mc.commitments {
+		var path opentimestamps.Sequence
+		if before := all[:i*32]; len(before) > 0 {
+			path = append(path, opentimestamps.Instruction{Operation: opPrepend, Argument: before})
+		}
+		if after := all[(i+1)*32:]; len(after) > 0 {
+			path = append(path, opentimestamps.Instruction{Operation: opAppend, Argument: after})
+		}
+		path = append(path,
+			opentimestamps.Instruction{Operation: opSHA256},
+			opentimestamps.Instruction{Attestation: &opentimestamps.Attestation{BitcoinBlockHeight: height}},
+		)
+		mc.upgrades[hex.EncodeToString(commitment)] = path
+	}
+	me.setBlock(height, chainhash.Hash(sha256.Sum256(all)))
+}
+
+func (mc *mockCalendar) stampCount() int {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.stamps
+}
+
+// serializeSequence is a sequence the way calendars send it
+func serializeSequence(seq opentimestamps.Sequence) []byte {
+	return opentimestamps.File{Sequences: []opentimestamps.Sequence{seq}}.SerializeInstructionSequences()
+}
+
+// mockRelay is a nostr relay in memory: it keeps every event it accepts and answers REQs with the stored events
+// that match (newest first, at most limit per filter, and per query if set) followed by an EOSE.
+// open subscriptions also get the events added after that.
+type mockRelay struct {
+	url string
+
+	mu        sync.Mutex
+	events    []nostr.Event
+	published map[string]int // how many times each event id was sent to us
+	subs      map[*mockSub]struct{}
+	limit     int
+	reject    func(nostr.Event) string // the OK false reason for an event, "" to accept it
+}
+
+type mockSub struct {
+	id      string
+	filters nostr.Filters
+	send    func(nostr.Envelope) error
+}
+
+func newMockRelay(t *testing.T) *mockRelay {
+	mr := &mockRelay{published: make(map[string]int), subs: make(map[*mockSub]struct{})}
+	server := httptest.NewServer(http.HandlerFunc(mr.serve))
+	t.Cleanup(server.Close)
+	mr.url = "ws" + strings.TrimPrefix(server.URL, "http")
+	return mr
+}
+
+func (mr *mockRelay) serve(w http.ResponseWriter, r *http.Request) {
+	conn, _, _, err := ws.UpgradeHTTP(r, w)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	send := func(env nostr.Envelope) error {
+		b, _ := env.MarshalJSON()
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return wsutil.WriteServerText(conn, b)
+	}
+
+	subs := make(map[string]*mockSub)
+	defer func() {
+		mr.mu.Lock()
+		for _, sub := range subs {
+			delete(mr.subs, sub)
+		}
+		mr.mu.Unlock()
+	}()
+
+	for {
+		message, err := wsutil.ReadClientText(conn)
+		if err != nil {
+			return
+		}
+
+		switch env := nostr.ParseMessage(message).(type) {
+		case *nostr.EventEnvelope:
+			event := env.Event
+			reason := ""
+			if ok, _ := event.CheckSignature(); !ok {
+				reason = "invalid: bad signature"
+			} else if mr.reject != nil {
+				reason = mr.reject(event)
+			}
+
+			mr.mu.Lock()
+			mr.published[event.ID]++
+			if reason == "" {
+				mr.events = append(mr.events, event)
+			}
+			mr.mu.Unlock()
+
+			if err := send(&nostr.OKEnvelope{EventID: event.ID, OK: reason == "", Reason: &reason}); err != nil {
+				return
+			}
+		case *nostr.ReqEnvelope:
+			for _, event := range mr.query(env.Filters) {
+				event := event
+				if err := send(&nostr.EventEnvelope{SubscriptionID: &env.SubscriptionID, Event: event}); err != nil {
+					return
+				}
+			}
+			eose := nostr.EOSEEnvelope(env.SubscriptionID)
+			if err := send(&eose); err != nil {
+				return
+			}
+
+			sub := &mockSub{id: env.SubscriptionID, filters: env.Filters, send: send}
+			mr.mu.Lock()
+			if old, ok := subs[sub.id]; ok {
+				delete(mr.subs, old)
+			}
+			subs[sub.id] = sub
+			mr.subs[sub] = struct{}{}
+			mr.mu.Unlock()
+		case *nostr.CloseEnvelope:
+			mr.mu.Lock()
+			if sub, ok := subs[string(*env)]; ok {
+				delete(mr.subs, sub)
+				delete(subs, sub.id)
+			}
+			mr.mu.Unlock()
+		}
+	}
+}
+
+func (mr *mockRelay) query(filters nostr.Filters) []nostr.Event {
+	mr.mu.Lock()
+	events := append([]nostr.Event{}, mr.events...)
+	mr.mu.Unlock()
+	sort.SliceStable(events, func(i, j int) bool { return events[i].CreatedAt > events[j].CreatedAt })
+
+	var result []nostr.Event
+	returned := make(map[string]bool)
+	for _, filter := range filters {
+		n := 0
+		for _, event := range events {
+			if (filter.Limit > 0 && n >= filter.Limit) || (mr.limit > 0 && n >= mr.limit) {
+				break
+			}
+			if !filter.Matches(&event) {
+				continue
+			}
+			n++
+			if !returned[event.ID] {
+				returned[event.ID] = true
+				result = append(result, event)
+			}
+		}
+	}
+	return result
+}
+
+// add stores events as if someone had published them, open subscriptions that match get them too
+func (mr *mockRelay) add(events ...nostr.Event) {
+	mr.mu.Lock()
+	mr.events = append(mr.events, events...)
+	subs := make([]*mockSub, 0, len(mr.subs))
+	for sub := range mr.subs {
+		subs = append(subs, sub)
+	}
+	mr.mu.Unlock()
+
+	for _, event := range events {
+		event := event
+		for _, sub := range subs {
+			if sub.filters.Match(&event) {
+				sub.send(&nostr.EventEnvelope{SubscriptionID: &sub.id, Event: event})
+			}
+		}
+	}
+}
+
+// sent is how many times the event was published to us, accepted or not
+func (mr *mockRelay) sent(id string) int {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	return mr.published[id]
+}
+
+// attestations are the kind-1040s we have for the given event id
+func (mr *mockRelay) attestations(id string) []nostr.Event {
+	return mr.query(nostr.Filters{{Kinds: []int{1040}, Tags: nostr.TagMap{"e": []string{id}}}})
+}
+
+// mockEsplora is an esplora server for the headers in chain, the tip is the highest one
+type mockEsplora struct {
+	url string
+
+	mu          sync.Mutex
+	chain       map[uint64]*wire.BlockHeader
+	tipFailures int // how many of the next tip requests fail
+	tipCalls    int
+	hashCalls   int
+}
+
+func newMockEsplora(t *testing.T, tip uint64) *mockEsplora {
+	me := &mockEsplora{chain: make(map[uint64]*wire.BlockHeader)}
+	for height := tip - 20; height <= tip; height++ {
+		me.setBlock(height, chainhash.Hash{byte(height), byte(height >> 8)})
+	}
+	server := httptest.NewServer(http.HandlerFunc(me.serve))
+	t.Cleanup(server.Close)
+	me.url = server.URL
+	return me
+}
+
+// setBlock puts a block with the given merkle root at height, replacing the one that was there
+func (me *mockEsplora) setBlock(height uint64, merkleRoot chainhash.Hash) *chainhash.Hash {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	header := &wire.BlockHeader{
+		Version:    int32(height),
+		MerkleRoot: merkleRoot,
+		Timestamp:  time.Unix(1231006505+int64(height)*600, 0),
+	}
+	me.chain[height] = header
+	hash := header.BlockHash()
+	return &hash
+}
+
+// tipHeight is the height of the highest block, with mu held
+func (me *mockEsplora) tipHeight() uint64 {
+	var tip uint64
+	for height := range me.chain {
+		tip = max(tip, height)
+	}
+	return tip
+}
+
+func (me *mockEsplora) serve(w http.ResponseWriter, r *http.Request) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	tip := me.tipHeight()
+	switch path := r.URL.Path; {
+	case path == "/blocks/tip/height":
+		me.tipCalls++
+		if me.tipFailures > 0 {
+			me.tipFailures--
+			// drop the connection, like an esplora that's down
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				conn.Close()
+			}
+			return
+		}
+		fmt.Fprint(w, tip)
+	case path == "/blocks/tip/hash":
+		fmt.Fprint(w, me.chain[tip].BlockHash())
+	case strings.HasPrefix(path, "/block-height/"):
+		me.hashCalls++
+		height, _ := strconv.ParseUint(strings.TrimPrefix(path, "/block-height/"), 10, 64)
+		header, ok := me.chain[height]
+		if !ok {
+			http.Error(w, "Block not found", http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, header.BlockHash())
+	case strings.HasPrefix(path, "/block/") && strings.HasSuffix(path, "/header"):
+		hash := strings.TrimSuffix(strings.TrimPrefix(path, "/block/"), "/header")
+		for _, header := range me.chain {
+			if header.BlockHash().String() == hash {
+				var buf bytes.Buffer
+				header.Serialize(&buf)
+				fmt.Fprint(w, hex.EncodeToString(buf.Bytes()))
+				return
+			}
+		}
+		http.Error(w, "Block not found", http.StatusNotFound)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// useEsplora gets blocks from the mock and starts with an empty block cache
+func useEsplora(t *testing.T, me *mockEsplora) {
+	s.Esplora = []string{me.url}
+	previous := blockSource
+	blockSource = esploras(s.Esplora)
+	t.Cleanup(func() { blockSource = previous })
+
+	reset := func() {
+		blockCache.Lock()
+		blockCache.headers = make(map[chainhash.Hash]*wire.BlockHeader)
+		blockCache.hashes = make(map[uint64]*chainhash.Hash)
+		blockCache.order = nil
+		blockCache.heights = nil
+		blockCache.Unlock()
+		highestTip.Lock()
+		highestTip.height = 0
+		highestTip.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// harness is the bot wired to a mock calendar, a mock relay and a mock esplora
+type harness struct {
+	ctx      context.Context
+	calendar *mockCalendar
+	relay    *mockRelay
+	esplora  *mockEsplora
+	pool     *RelayPool
+}
+
+func newHarness(t *testing.T) *harness {
+	setup(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	h := &harness{
+		ctx:      ctx,
+		calendar: newMockCalendar(t),
+		relay:    newMockRelay(t),
+		esplora:  newMockEsplora(t, 800_000),
+		pool:     NewRelayPool(ctx),
+	}
+	useEsplora(t, h.esplora)
+
+	s.Calendars = []string{h.calendar.url}
+	s.Relays = []string{h.relay.url}
+	s.SecretKey = nostr.GeneratePrivateKey()
+	botPubkey, _ = nostr.GetPublicKey(s.SecretKey)
+	s.StampRetryDelay = 10 * time.Millisecond
+	s.PublishRetryDelay = 10 * time.Millisecond
+	return h
+}
+
+// tip is the current block of the mock esplora
+func (h *harness) tip(t *testing.T) (uint64, string) {
+	t.Helper()
+	height, hash, err := getTip(h.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return height, hash
+}
+
+// confirm puts everything stamped so far in a block a few blocks below the tip
+func (h *harness) confirm(t *testing.T) uint64 {
+	h.esplora.mu.Lock()
+	height := h.esplora.tipHeight() - 3
+	h.esplora.mu.Unlock()
+	h.calendar.confirm(h.esplora, height)
+	return height
+}
+
+func TestStampUpgradePublish(t *testing.T) {
+	h := newHarness(t)
+
+	event := testEvent(t, "it will rain tomorrow")
+	h.relay.add(event)
+	if !handleEvent(h.ctx, store, h.pool, event, []string{h.relay.url}) {
+		t.Fatal("event wasn't stamped")
+	}
+	if !store.HasStamp(event.ID) {
+		t.Fatal("stamp wasn't saved")
+	}
+
+	// nothing happens while it's pending
+	height, hash := h.tip(t)
+	if err := upgradeAndPublish(h.ctx, store, h.pool, event.ID, height, hash); err != nil {
+		t.Fatalf("failed while pending: %s", err)
+	}
+	if len(h.relay.attestations(event.ID)) != 0 || !store.HasStamp(event.ID) {
+		t.Fatal("published before the timestamp was confirmed")
+	}
+
+	blockHeight := h.confirm(t)
+	if err := upgradeAndPublish(h.ctx, store, h.pool, event.ID, height, hash); err != nil {
+		t.Fatalf("failed to upgrade and publish: %s", err)
+	}
+
+	attestations := h.relay.attestations(event.ID)
+	if len(attestations) != 1 {
+		t.Fatalf("expected one attestation on the relay, got %d", len(attestations))
+	}
+	attestation := attestations[0]
+	if tag := attestation.Tags.GetFirst([]string{"e", event.ID}); tag == nil || (*tag)[2] != h.relay.url {
+		t.Errorf("attestation has e tag %v, expected the event from %s", tag, h.relay.url)
+	}
+	if tag := attestation.Tags.GetFirst([]string{"p", event.PubKey}); tag == nil {
+		t.Errorf("attestation doesn't tag the author")
+	}
+	if tag := attestation.Tags.GetFirst([]string{"block", ""}); tag == nil || (*tag)[1] != strconv.FormatUint(height, 10) || (*tag)[2] != hash {
+		t.Errorf("attestation has block tag %v, expected the tip %d %s", tag, height, hash)
+	}
+	blockTime := h.esplora.chain[blockHeight].Timestamp.Unix()
+	if tag := attestation.Tags.GetFirst([]string{"time", ""}); tag == nil || (*tag)[1] != strconv.FormatInt(blockTime, 10) {
+		t.Errorf("attestation has time tag %v, expected %d", tag, blockTime)
+	}
+
+	file := attestationFile(t, attestation)
+	if hex.EncodeToString(file.Digest) != event.ID {
+		t.Errorf("attestation is for digest %x", file.Digest)
+	}
+	seqs := file.GetBitcoinAttestedSequences()
+	if len(seqs) != 1 || seqs[0].GetAttestation().BitcoinBlockHeight != blockHeight {
+		t.Fatalf("attestation isn't in block %d: %s", blockHeight, file.Human())
+	}
+	if err := verifyAttestation(h.ctx, seqs[0], file.Digest); err != nil {
+		t.Errorf("attestation doesn't verify: %s", err)
+	}
+
+	if store.HasStamp(event.ID) {
+		t.Errorf("stamp wasn't removed from the store after publishing")
+	}
+}
+
+// attestationFile is the ots in a kind-1040
+func attestationFile(t *testing.T, attestation nostr.Event) *opentimestamps.File {
+	t.Helper()
+	data := mustBase64(t, attestation.Content)
+	file, err := opentimestamps.ReadFromFile(data)
+	if err != nil {
+		t.Fatalf("attestation has an invalid ots: %s", err)
+	}
+	return file
+}
+
+func mustBase64(t *testing.T, str string) []byte {
+	t.Helper()
+	b, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
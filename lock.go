@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockID takes a lock on id that is visible to all instances sharing DATA_DIR, so only one of them
+// works on it at a time. it returns false if someone else has it. it's a flock on a file, so the kernel
+// drops it when the instance holding it dies.
+func lockID(id string) (unlock func(), ok bool) {
+	path := filepath.Join(s.DataDir, PREFIX_LOCK+id+SUFFIX_LOCK)
+
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			// if we can't lock at all it's better to go on than to never upgrade anything
+			slog.Warn("failed to lock", "event_id", id, "error", err)
+			return func() {}, true
+		}
+
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			file.Close()
+			if errors.Is(err, syscall.EWOULDBLOCK) {
+				return nil, false
+			}
+			slog.Warn("failed to lock", "event_id", id, "error", err)
+			return func() {}, true
+		}
+
+		// whoever had it before may have removed the file after we opened it, then our lock is on
+		// nothing and we have to lock the new one
+		opened, err := file.Stat()
+		if err == nil {
+			current, err := os.Stat(path)
+			if os.IsNotExist(err) || (err == nil && !os.SameFile(opened, current)) {
+				file.Close()
+				continue
+			}
+		}
+
+		return func() {
+			os.Remove(path)
+			file.Close()
+		}, true
+	}
+}
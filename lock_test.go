@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestLockID(t *testing.T) {
+	setup(t)
+	s.SecretKey = nostr.GeneratePrivateKey()
+	id := testEvent(t, "locked").ID
+	path := filepath.Join(s.DataDir, PREFIX_LOCK+id+SUFFIX_LOCK)
+
+	unlock, ok := lockID(id)
+	if !ok {
+		t.Fatal("failed to lock")
+	}
+	if _, ok := lockID(id); ok {
+		t.Errorf("locked the same id twice")
+	}
+	if err := republish(context.Background(), []string{id}); err == nil || !strings.Contains(err.Error(), "being published") {
+		t.Errorf("republish didn't wait for the lock: %v", err)
+	}
+
+	unlock()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lock file is still there after unlocking")
+	}
+	unlock, ok = lockID(id)
+	if !ok {
+		t.Fatal("failed to lock again after unlocking")
+	}
+	unlock()
+}
+
+func TestLockOfDeadInstanceIsFree(t *testing.T) {
+	setup(t)
+	id := testEvent(t, "left behind").ID
+
+	// an instance that died while holding the lock leaves the file, but the kernel dropped its flock
+	file, err := os.Create(filepath.Join(s.DataDir, PREFIX_LOCK+id+SUFFIX_LOCK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lockID(id); ok {
+		t.Fatal("locked an id that was still locked")
+	}
+	file.Close()
+
+	unlock, ok := lockID(id)
+	if !ok {
+		t.Fatal("the lock of a dead instance wasn't released")
+	}
+	unlock()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// setup loads the default settings with a fresh data directory and a file store on it
+func setup(t *testing.T) {
+	t.Helper()
+
+	s = Settings{}
+	if err := envconfig.Process("", &s); err != nil {
+		t.Fatalf("failed to load default settings: %s", err)
+	}
+	s.DataDir = t.TempDir()
+	store = FileStore{dir: s.DataDir}
+}
+
+func TestTamperedEventIsRejected(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for SIGHTING_WINDOW")
+	}
+	h := newHarness(t)
+	s.SkipExisting = false
+	s.InitialLimit = 10
+
+	// same id and signature, different content
+	event := testEvent(t, "the real one")
+	forged := event
+	forged.Content = "the forged one"
+
+	// a forged event with its own id, only the signature is wrong
+	resigned := testEvent(t, "someone else's")
+	resigned.Content = "changed after signing"
+	resigned.ID = resigned.GetID()
+
+	forger := newMockRelay(t)
+	forger.add(forged, resigned)
+	h.relay.add(event)
+	s.Relays = []string{forger.url, h.relay.url}
+
+	ctx, cancel := context.WithCancel(h.ctx)
+	done := make(chan struct{})
+	go func() {
+		receiveLoop(ctx, store, h.pool)
+		close(done)
+	}()
+	deadline := time.Now().Add(SIGHTING_WINDOW + 10*time.Second)
+	for !store.HasStamp(event.ID) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	stored, _, _, err := store.Load(event.ID)
+	if err != nil {
+		t.Fatalf("real event wasn't stamped: %s", err)
+	}
+	if stored.Content != event.Content {
+		t.Errorf("stored the forged content %q", stored.Content)
+	}
+	if store.HasStamp(resigned.ID) {
+		t.Errorf("event with a bad signature was stamped")
+	}
+	if n := h.calendar.stampCount(); n != 1 {
+		t.Errorf("expected only the real event to be stamped, got %d stamps", n)
+	}
+}
+
+func TestInitialLimitThenLiveEvents(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for SIGHTING_WINDOW")
+	}
+	h := newHarness(t)
+	s.SkipExisting = false
+	s.InitialLimit = 2
+
+	var stored []nostr.Event
+	for i, age := range []nostr.Timestamp{30, 20, 10} {
+		event := testEvent(t, fmt.Sprint("stored ", i))
+		event.CreatedAt = nostr.Now() - age
+		event.Sign(nostr.GeneratePrivateKey())
+		stored = append(stored, event)
+	}
+	h.relay.add(stored...)
+
+	ctx, cancel := context.WithCancel(h.ctx)
+	done := make(chan struct{})
+	go func() {
+		receiveLoop(ctx, store, h.pool)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitForStamps := func(ids ...string) {
+		t.Helper()
+		deadline := time.Now().Add(SIGHTING_WINDOW + 10*time.Second)
+		for _, id := range ids {
+			for !store.HasStamp(id) {
+				if time.Now().After(deadline) {
+					t.Fatalf("event %s wasn't stamped", id)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+	}
+
+	// only the newest stored ones
+	waitForStamps(stored[1].ID, stored[2].ID)
+	if store.HasStamp(stored[0].ID) {
+		t.Errorf("got more stored events than INITIAL_LIMIT")
+	}
+
+	// the subscription is still open after the EOSE
+	live := testEvent(t, "live")
+	h.relay.add(live)
+	waitForStamps(live.ID)
+}
+
+func TestParseSecretKey(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	nsec, _ := nip19.EncodePrivateKey(sk)
+	npub, _ := nip19.EncodePublicKey(mustPubkey(t, sk))
+	badNsec := nsec[:len(nsec)-1] + "q"
+	if strings.HasSuffix(nsec, "q") {
+		badNsec = nsec[:len(nsec)-1] + "p"
+	}
+
+	for _, tc := range []struct {
+		name string
+		key  string
+		ok   bool
+	}{
+		{"hex", sk, true},
+		{"uppercase hex", strings.ToUpper(sk), true},
+		{"with a newline", sk + "\n", true},
+		{"nsec", nsec, true},
+		{"bad hex", "zz" + sk[2:], false},
+		{"odd length", sk[:63], false},
+		{"too short", sk[:62], false},
+		{"too long", sk + "00", false},
+		{"empty", "", false},
+		{"bad nsec checksum", badNsec, false},
+		{"truncated nsec", nsec[:len(nsec)-5], false},
+		{"npub", npub, false},
+		{"zero", strings.Repeat("0", 64), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := parseSecretKey(tc.key)
+			if (err == nil) != tc.ok {
+				t.Fatalf("got %v", err)
+			}
+			if tc.ok && key != sk {
+				t.Errorf("got %s, expected %s", key, sk)
+			}
+		})
+	}
+}
+
+func mustPubkey(t *testing.T, sk string) string {
+	t.Helper()
+	pk, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
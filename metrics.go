@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	stampsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "stamps_total",
+		Help: "Events that were stamped and saved.",
+	})
+	stampFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "stamp_failures_total",
+		Help: "Calendar stamp calls that failed.",
+	})
+	stampTimeoutsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "stamp_timeouts_total",
+		Help: "Incoming events that took longer than EVENT_TIMEOUT to handle.",
+	})
+	upgradesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "upgrades_total",
+		Help: "Sequences that were upgraded to a bitcoin attestation.",
+	})
+	upgradeFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "upgrade_failures_total",
+		Help: "Sequence upgrade attempts that failed (including ones that are still pending).",
+	})
+	eventsPublishedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "events_published_total",
+		Help: "Kind-1040 events that were published.",
+	})
+	confirmationSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "confirmation_seconds",
+		Help:    "Time from stamping an event to publishing its bitcoin attestation.",
+		Buckets: prometheus.ExponentialBuckets(600, 2, 10), // 10 minutes to ~3.5 days
+	})
+	pendingTimestamps = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pending_timestamps",
+		Help: "Timestamps waiting to be upgraded and published.",
+	})
+	calendarRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "calendar_requests_total",
+		Help: "Stamp requests to each calendar, by result (success or failure).",
+	}, []string{"calendar", "result"})
+	stampErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "stamp_errors_total",
+		Help: "Failed stamp requests to each calendar, by type (timeout, connection, rejected, server, invalid, other).",
+	}, []string{"calendar", "type"})
+	calendarRequestSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "calendar_request_seconds",
+		Help: "How long stamp requests to each calendar took.",
+	}, []string{"calendar"})
+)
+
+// calendarStats is what we log about each calendar every CALENDAR_SUMMARY_INTERVAL, it's reset after that
+var calendarStats = struct {
+	sync.Mutex
+	calendars map[string]*calendarStat
+}{calendars: make(map[string]*calendarStat)}
+
+type calendarStat struct {
+	successes int
+	failures  int
+	elapsed   time.Duration
+}
+
+// observeCalendar records a stamp request to calendar that took d and failed if err isn't nil
+func observeCalendar(calendar string, d time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	calendarRequestsTotal.WithLabelValues(calendar, result).Inc()
+	calendarRequestSeconds.WithLabelValues(calendar).Observe(d.Seconds())
+
+	calendarStats.Lock()
+	defer calendarStats.Unlock()
+	stat, ok := calendarStats.calendars[calendar]
+	if !ok {
+		stat = &calendarStat{}
+		calendarStats.calendars[calendar] = stat
+	}
+	if err != nil {
+		stat.failures++
+	} else {
+		stat.successes++
+	}
+	stat.elapsed += d
+}
+
+// logCalendarSummary logs the success rate and average latency of each calendar periodically
+func logCalendarSummary(ctx context.Context) {
+	for sleep(ctx, CALENDAR_SUMMARY_INTERVAL) {
+		calendarStats.Lock()
+		for calendar, stat := range calendarStats.calendars {
+			total := stat.successes + stat.failures
+			slog.Info("calendar summary", "calendar", calendar, "requests", total,
+				"success_rate", fmt.Sprintf("%.1f%%", 100*float64(stat.successes)/float64(total)),
+				"average_latency", (stat.elapsed / time.Duration(total)).Truncate(time.Millisecond).String())
+		}
+		calendarStats.calendars = make(map[string]*calendarStat)
+		calendarStats.Unlock()
+	}
+}
+
+func serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	slog.Info("serving metrics", "addr", s.MetricsAddr)
+	if err := http.ListenAndServe(s.MetricsAddr, mux); err != nil {
+		slog.Error("metrics server failed", "error", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+// Notifier tells the operator that something is going wrong
+type Notifier interface {
+	Notify(ctx context.Context, message string) error
+}
+
+var notifiers []Notifier
+
+// WebhookNotifier POSTs {"text": message} to a url
+type WebhookNotifier struct {
+	url string
+}
+
+func (wn WebhookNotifier) Notify(ctx context.Context, message string) error {
+	body, _ := json.Marshal(map[string]string{"text": message})
+	req, err := http.NewRequestWithContext(ctx, "POST", wn.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// DMNotifier sends a NIP-04 direct message to pubkey from the bot's own key
+type DMNotifier struct {
+	pool   *RelayPool
+	pubkey string
+}
+
+func (dn DMNotifier) Notify(ctx context.Context, message string) error {
+	shared, err := nip04.ComputeSharedSecret(dn.pubkey, s.SecretKey)
+	if err != nil {
+		return err
+	}
+	content, err := nip04.Encrypt(message, shared)
+	if err != nil {
+		return err
+	}
+
+	dm := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      4,
+		Content:   content,
+		Tags:      nostr.Tags{nostr.Tag{"p", dn.pubkey}},
+	}
+	if err := dm.Sign(s.SecretKey); err != nil {
+		return err
+	}
+	if published := publishToRelays(ctx, dn.pool, dm, s.Relays); len(published) == 0 {
+		return fmt.Errorf("failed to publish to any relay")
+	}
+	return nil
+}
+
+// failures keeps the recent failures of each kind so we only alert when they pile up
+var failures = struct {
+	sync.Mutex
+	times map[string][]time.Time
+}{times: make(map[string][]time.Time)}
+
+// notifyFailure records a failure of the given kind ("stamp", "upgrade") and notifies the operator
+// when there have been NOTIFY_THRESHOLD of them within NOTIFY_WINDOW
+func notifyFailure(kind string, err error) {
+	if len(notifiers) == 0 {
+		return
+	}
+
+	failures.Lock()
+	now := time.Now()
+	recent := make([]time.Time, 0, s.NotifyThreshold)
+	for _, t := range failures.times[kind] {
+		if now.Sub(t) < s.NotifyWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < s.NotifyThreshold {
+		failures.times[kind] = recent
+		failures.Unlock()
+		return
+	}
+	// start counting again so we don't send one of these for every failure after this
+	failures.times[kind] = nil
+	failures.Unlock()
+
+	message := fmt.Sprintf("%d %s failures in the last %s, the last one: %s", len(recent), kind, s.NotifyWindow, err)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		for _, notifier := range notifiers {
+			if err := notifier.Notify(ctx, message); err != nil {
+				slog.Warn("failed to notify", "error", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyDialer is set when PROXY is, for the connections we open ourselves that aren't http
+var proxyDialer proxy.ContextDialer
+
+// useProxy routes all our http requests (calendars and esplora, including the ones the opentimestamps
+// library makes through http.DefaultClient) and the BLOCKS_WEBSOCKET through a SOCKS5 proxy. hostnames
+// are resolved by the proxy, so .onion addresses work when the proxy is tor. http requests to this machine,
+// like a local BITCOIN_RPC, don't go through it.
+func useProxy(raw string) error {
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if proxyURL.Scheme != "socks5" || proxyURL.Host == "" {
+		return fmt.Errorf("must be like socks5://host:port")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if isLoopback(req.URL.Hostname()) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}
+	httpClient.Transport = transport
+	http.DefaultClient.Transport = transport
+
+	dialer, err := proxy.FromURL(proxyURL, proxy.Direct)
+	if err != nil {
+		return err
+	}
+	var ok bool
+	if proxyDialer, ok = dialer.(proxy.ContextDialer); !ok {
+		return fmt.Errorf("proxy dialer can't be canceled")
+	}
+
+	slog.Warn("PROXY doesn't apply to relay connections, those are made directly", "proxy", proxyURL.Host)
+	return nil
+}
+
+// isLoopback tells if host is this machine
+func isLoopback(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isOnion tells if the url points to a tor hidden service
+func isOnion(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && strings.HasSuffix(u.Hostname(), ".onion")
+}
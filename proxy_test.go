@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProxySkipsLoopback(t *testing.T) {
+	setup(t)
+	previous, previousDefault := httpClient.Transport, http.DefaultClient.Transport
+	t.Cleanup(func() {
+		httpClient.Transport, http.DefaultClient.Transport = previous, previousDefault
+		proxyDialer = nil
+	})
+	if err := useProxy("socks5://127.0.0.1:9050"); err != nil {
+		t.Fatal(err)
+	}
+
+	transport := http.DefaultClient.Transport.(*http.Transport)
+	for url, proxied := range map[string]bool{
+		"https://blockstream.info/api/blocks/tip/height": true,
+		"http://abcdefghijklmnop.onion/digest":           true,
+		"http://localhost:8332":                          false,
+		"http://bitcoind.localhost:8332":                 false,
+		"http://127.0.0.1:8332":                          false,
+		"http://[::1]:8332":                              false,
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		proxyURL, err := transport.Proxy(req)
+		if err != nil {
+			t.Fatalf("%s: %s", url, err)
+		}
+		if (proxyURL != nil) != proxied {
+			t.Errorf("%s: got proxy %v", url, proxyURL)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// RelayPool is like nostr.SimplePool, but it connects to relays using our own options,
+// i.e. answering NIP-42 AUTH challenges when RELAY_AUTH is enabled
+type RelayPool struct {
+	ctx    context.Context
+	mu     sync.Mutex
+	relays map[string]*nostr.Relay
+	locks  map[string]*sync.Mutex
+}
+
+func NewRelayPool(ctx context.Context) *RelayPool {
+	return &RelayPool{
+		ctx:    ctx,
+		relays: make(map[string]*nostr.Relay),
+		locks:  make(map[string]*sync.Mutex),
+	}
+}
+
+func (p *RelayPool) EnsureRelay(url string) (*nostr.Relay, error) {
+	nm := nostr.NormalizeURL(url)
+
+	// only one connection attempt per relay at a time, but don't block the others
+	p.mu.Lock()
+	lock, ok := p.locks[nm]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.locks[nm] = lock
+	}
+	p.mu.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	p.mu.Lock()
+	relay, ok := p.relays[nm]
+	p.mu.Unlock()
+	if ok && relay.IsConnected() {
+		return relay, nil
+	}
+
+	opts := make([]nostr.RelayOption, 0, 1)
+	if s.RelayAuth {
+		opts = append(opts, nostr.WithAuthHandler(func(ctx context.Context, authEvent *nostr.Event) bool {
+			if err := authEvent.Sign(s.SecretKey); err != nil {
+				slog.Warn("failed to sign auth event", "relay", nm, "error", err)
+				return false
+			}
+			slog.Debug("authenticating", "relay", nm)
+			return true
+		}))
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, 15*time.Second)
+	defer cancel()
+	relay, err := nostr.RelayConnect(ctx, nm, opts...)
+	if err != nil {
+		setRelay(nm, nil)
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	setRelay(nm, relay)
+
+	p.mu.Lock()
+	p.relays[nm] = relay
+	p.mu.Unlock()
+	return relay, nil
+}
+
+// SubManyEose queries all the given relays and returns their stored events without duplicates,
+// the channel is closed when all of them have sent an EOSE or failed
+func (p *RelayPool) SubManyEose(ctx context.Context, urls []string, filters nostr.Filters) chan nostr.IncomingEvent {
+	ctx, cancel := context.WithCancel(ctx)
+
+	events := make(chan nostr.IncomingEvent)
+	seen := sync.Map{}
+	wg := sync.WaitGroup{}
+	wg.Add(len(urls))
+
+	go func() {
+		wg.Wait()
+		cancel()
+		close(events)
+	}()
+
+	for _, url := range urls {
+		go func(url string) {
+			defer wg.Done()
+
+			relay, err := p.EnsureRelay(url)
+			if err != nil {
+				return
+			}
+			sub, err := relay.Subscribe(ctx, filters)
+			if err != nil {
+				return
+			}
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-sub.EndOfStoredEvents:
+					return
+				case evt, more := <-sub.Events:
+					if !more {
+						return
+					}
+					if _, already := seen.LoadOrStore(evt.ID, struct{}{}); already {
+						continue
+					}
+					select {
+					case events <- nostr.IncomingEvent{Event: evt, Relay: relay}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}(url)
+	}
+
+	return events
+}
+
+// publish sends the event to the relay, and if the relay wants us to authenticate first
+// it waits a little for the AUTH to go through and tries again
+func publish(ctx context.Context, relay *nostr.Relay, event nostr.Event) (nostr.Status, error) {
+	status, err := relay.Publish(ctx, event)
+	if s.RelayAuth && err != nil && strings.HasPrefix(strings.TrimPrefix(err.Error(), "msg: "), "auth-required:") {
+		if !sleep(ctx, 2*time.Second) {
+			return status, err
+		}
+		status, err = relay.Publish(ctx, event)
+	}
+	return status, err
+}
+
+// listen keeps a subscription open on a single relay and sends everything it gets to events,
+// reconnecting whenever the relay drops without affecting the others.
+// caughtUp is called after the first EOSE, when the relay has sent everything it had stored.
+func listen(ctx context.Context, pool *RelayPool, url string, filters nostr.Filters, events chan<- nostr.IncomingEvent, caughtUp func()) {
+	if !stagger(ctx) {
+		return
+	}
+
+	delay := RECONNECT_MIN_DELAY
+	for {
+		relay, err := pool.EnsureRelay(url)
+		if err != nil {
+			slog.Warn("failed to connect", "relay", url, "error", err)
+		} else {
+			sub, err := relay.Subscribe(ctx, filters)
+			if err != nil {
+				slog.Warn("failed to subscribe", "relay", url, "error", err)
+			} else {
+				slog.Info("subscribed", "relay", url)
+				delay = RECONNECT_MIN_DELAY
+
+				// the limit only applies to stored events, the subscription stays open for new ones after the EOSE
+				go func() {
+					select {
+					case <-sub.EndOfStoredEvents:
+						slog.Debug("got stored events, waiting for new ones", "relay", url)
+						caughtUp()
+					case <-sub.Context.Done():
+					}
+				}()
+				for evt := range sub.Events {
+					select {
+					case events <- nostr.IncomingEvent{Event: evt, Relay: relay}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		slog.Warn("lost connection, will reconnect", "relay", url, "delay", delay.String())
+		if !sleep(ctx, delay) {
+			return
+		}
+		delay = min(delay*2, s.ReconnectMaxDelay)
+	}
+}
+
+// publishToRelays publishes the event to all the given relays at the same time and returns
+// the ones that accepted it. everything we send goes through here, so this is where DRY_RUN stops it.
+func publishToRelays(ctx context.Context, pool *RelayPool, event nostr.Event, urls []string) []string {
+	if s.DryRun {
+		slog.Info("would publish (dry run)", "kind", event.Kind, "relays", urls, "event", event)
+		return nil
+	}
+
+	published := make([]string, 0, len(urls))
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	seen := make(map[string]struct{}, len(urls))
+	for _, url := range urls {
+		if url == "" {
+			continue
+		}
+		nm := nostr.NormalizeURL(url)
+		if _, ok := seen[nm]; ok {
+			continue
+		}
+		seen[nm] = struct{}{}
+
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+
+			// relays often fail for a moment (rate limits, restarts), so try a few times before giving up on one
+			rejected := ""
+			err := retry(ctx, s.PublishAttempts, s.PublishRetryDelay, func() error {
+				relay, err := pool.EnsureRelay(url)
+				if err != nil {
+					return fmt.Errorf("failed to get relay: %w", err)
+				}
+
+				ctx, cancel := context.WithTimeout(ctx, s.PublishTimeout)
+				defer cancel()
+				status, err := publish(ctx, relay, event)
+				switch {
+				case err != nil && strings.HasPrefix(err.Error(), "msg: "):
+					// the relay answered with an OK false, trying again won't change some of these
+					reason := strings.TrimPrefix(err.Error(), "msg: ")
+					if permanentRejection(reason) {
+						rejected = reason
+						return nil
+					}
+					return err
+				case err == nil && status != nostr.PublishStatusSucceeded:
+					return errNotConfirmed
+				}
+				return err
+			})
+			switch {
+			case rejected != "":
+				slog.Warn("relay rejected the event", "attestation_id", event.ID, "relay", url, "reason", rejected)
+				return
+			case err == errNotConfirmed:
+				slog.Warn("relay didn't confirm the event in time", "attestation_id", event.ID, "relay", url,
+					"timeout", s.PublishTimeout.String(), "attempts", s.PublishAttempts)
+				return
+			case err != nil && strings.HasPrefix(err.Error(), "msg: "):
+				slog.Warn("relay rejected the event", "attestation_id", event.ID, "relay", url,
+					"reason", strings.TrimPrefix(err.Error(), "msg: "), "attempts", s.PublishAttempts)
+				return
+			case err != nil:
+				slog.Warn("failed to publish", "attestation_id", event.ID, "relay", url, "error", err,
+					"attempts", s.PublishAttempts)
+				return
+			}
+
+			mu.Lock()
+			published = append(published, url)
+			mu.Unlock()
+		}(nm)
+	}
+
+	wg.Wait()
+	return published
+}
+
+// publishRelays is where the attestation (and the notes) for an event go: the relay we reference in the tags
+// plus PUBLISH_RELAYS if set, otherwise plus the relays the event was seen on and RELAYS
+func publishRelays(eventRelay string, eventRelays []string) []string {
+	if len(s.PublishRelays) > 0 {
+		return append([]string{eventRelay}, s.PublishRelays...)
+	}
+	return append(append([]string{eventRelay}, eventRelays...), s.Relays...)
+}
+
+// otherRelays are the candidates that aren't in tried
+func otherRelays(tried []string, candidates []string) []string {
+	skip := make(map[string]bool, len(tried))
+	for _, url := range tried {
+		skip[nostr.NormalizeURL(url)] = true
+	}
+	others := make([]string, 0, len(candidates))
+	for _, url := range candidates {
+		if nm := nostr.NormalizeURL(url); url != "" && !skip[nm] {
+			skip[nm] = true
+			others = append(others, url)
+		}
+	}
+	return others
+}
+
+var errNotConfirmed = errors.New("relay didn't confirm the event")
+
+// permanentRejection tells if an OK false reason (NIP-01 prefixes) means the relay will never take the event
+func permanentRejection(reason string) bool {
+	for _, prefix := range []string{"blocked:", "invalid:", "pow:", "restricted:"} {
+		if strings.HasPrefix(reason, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// bestRelay picks the relay we reference in tags out of the ones an event was seen on:
+// the first one we're currently connected to, otherwise just the first one
+func bestRelay(relays []string) string {
+	connected := make(map[string]bool)
+	for url, ok := range relayStates() {
+		connected[nostr.NormalizeURL(url)] = ok
+	}
+	for _, url := range relays {
+		if connected[nostr.NormalizeURL(url)] {
+			return url
+		}
+	}
+	if len(relays) > 0 {
+		return relays[0]
+	}
+	return ""
+}
+
+// relayURL is the relay an incoming event came from, or "" if the library didn't tell us
+func relayURL(ie nostr.IncomingEvent) string {
+	if ie.Relay == nil {
+		slog.Warn("event came without relay information", "event_id", ie.ID)
+		return ""
+	}
+	return ie.Relay.URL
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRelayURLWithoutRelay(t *testing.T) {
+	event := testEvent(t, "no relay")
+	if url := relayURL(nostr.IncomingEvent{Event: &event, Relay: nil}); url != "" {
+		t.Errorf("expected no relay, got %s", url)
+	}
+
+	relay := &nostr.Relay{URL: "wss://relay.example.com"}
+	if url := relayURL(nostr.IncomingEvent{Event: &event, Relay: relay}); url != relay.URL {
+		t.Errorf("expected %s, got %s", relay.URL, url)
+	}
+}
+
+func TestPublishToRelays(t *testing.T) {
+	h := newHarness(t)
+
+	blocking := newMockRelay(t)
+	blocking.reject = func(nostr.Event) string { return "blocked: not on the list" }
+	down := "ws://127.0.0.1:1"
+
+	event := testEvent(t, "publish me")
+	published := publishToRelays(h.ctx, h.pool, event, []string{h.relay.url, h.relay.url + "/", "", blocking.url, down})
+
+	if len(published) != 1 || published[0] != nostr.NormalizeURL(h.relay.url) {
+		t.Errorf("expected it to be published only to %s, got %v", h.relay.url, published)
+	}
+	if n := h.relay.sent(event.ID); n != 1 {
+		t.Errorf("the same relay got it %d times", n)
+	}
+	if n := blocking.sent(event.ID); n != 1 {
+		t.Errorf("a relay that blocked it got it %d times, shouldn't retry", n)
+	}
+	if got := h.relay.query(nostr.Filters{{IDs: []string{event.ID}}}); len(got) != 1 {
+		t.Errorf("relay doesn't have the event")
+	}
+}
+
+func TestPublishToRelaysRetries(t *testing.T) {
+	h := newHarness(t)
+
+	// busy the first time
+	busy := true
+	h.relay.reject = func(nostr.Event) string {
+		if busy {
+			busy = false
+			return "error: try again later"
+		}
+		return ""
+	}
+
+	event := testEvent(t, "publish me again")
+	if published := publishToRelays(h.ctx, h.pool, event, []string{h.relay.url}); len(published) != 1 {
+		t.Errorf("wasn't published after the relay recovered")
+	}
+	if n := h.relay.sent(event.ID); n != 2 {
+		t.Errorf("expected 2 attempts, got %d", n)
+	}
+}
+
+func TestDryRunSendsNothing(t *testing.T) {
+	h := newHarness(t)
+	s.DryRun = true
+
+	event := testEvent(t, "don't publish me")
+	if published := publishToRelays(h.ctx, h.pool, event, []string{h.relay.url}); len(published) != 0 {
+		t.Errorf("published to %v in a dry run", published)
+	}
+	if n := h.relay.sent(event.ID); n != 0 {
+		t.Errorf("relay got the event %d times in a dry run", n)
+	}
+
+	// not even the paths that don't go through the upgrade loop
+	s.Relays = []string{h.relay.url}
+	if err := (DMNotifier{h.pool, mustPubkey(t, nostr.GeneratePrivateKey())}).Notify(h.ctx, "hi"); err == nil {
+		t.Errorf("DM was sent in a dry run")
+	}
+	attestation := testEvent(t, "already published")
+	if err := store.SavePublished(event.ID, attestation, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := republish(h.ctx, []string{event.ID}); err == nil {
+		t.Errorf("republished in a dry run")
+	}
+	if events := h.relay.query(nostr.Filters{{}}); len(events) != 0 {
+		t.Errorf("relay got %d events in a dry run", len(events))
+	}
+}
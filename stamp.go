@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/opentimestamps"
+)
+
+// handleEvent stamps an event that was seen on the given relays unless it was already stamped by us
+// or by someone else, returns true if it was stamped now
+func handleEvent(ctx context.Context, store StampStore, pool *RelayPool, event nostr.Event, relays []string) bool {
+	slog.Info("stamping event", "event_id", event.ID, "relays", relays)
+
+	if err := checkID(event); err != nil {
+		slog.Warn("invalid event id", "event_id", event.ID, "relays", relays, "error", err)
+		return false
+	}
+
+	if size := len(event.String()); s.MaxEventSize > 0 && size > s.MaxEventSize {
+		slog.Warn("event is too big", "event_id", event.ID, "size", size, "max", s.MaxEventSize)
+		return false
+	}
+
+	if !allowedAuthor(event.PubKey) {
+		slog.Info("author not allowed", "event_id", event.ID, "pubkey", event.PubKey)
+		return false
+	}
+
+	if s.MinPow > 0 {
+		if err := nip13.Check(event.ID, s.MinPow); err != nil {
+			slog.Info("not enough proof of work", "event_id", event.ID, "difficulty", nip13.Difficulty(event.ID))
+			return false
+		}
+	}
+
+	if store.HasStamp(event.ID) {
+		slog.Debug("stamp already exists", "event_id", event.ID)
+		return false
+	}
+
+	digest, _ := hex.DecodeString(event.ID)
+	if s.SkipExisting && hasAttestation(ctx, pool, event.ID, digest, nil, append(relays, s.Relays...)) {
+		slog.Info("event already has an attestation", "event_id", event.ID)
+		return false
+	}
+
+	if s.StampContent {
+		if err := stampContent(ctx, store, event, relays); errors.Is(err, errStampInFlight) {
+			slog.Debug("content is already being stamped", "event_id", event.ID, "content_hash", contentKey(event))
+		} else if errors.Is(err, errStampRefused) {
+			slog.Error("failed to stamp content, not retrying", "event_id", event.ID, "content_hash", contentKey(event), "error", err)
+		} else if err != nil {
+			key := contentKey(event)
+			slog.Error("failed to stamp content, will retry later", "event_id", event.ID, "content_hash", key, "error", err)
+			if err := store.Save(key, event, relays, nil); err != nil {
+				slog.Error("failed to save event for retrying", "event_id", event.ID, "error", err)
+			}
+		} else {
+			publishIfComplete(ctx, store, pool, contentKey(event))
+		}
+	}
+
+	if err := stampEvent(ctx, store, event, relays); errors.Is(err, errStampInFlight) {
+		// it came from somewhere else at the same time, that one will get it stamped
+		slog.Debug("event is already being stamped", "event_id", event.ID)
+		return false
+	} else if errors.Is(err, errStampRefused) {
+		// trying again won't help
+		slog.Error("failed to stamp, not retrying", "event_id", event.ID, "error", err)
+		notifyFailure("stamp", err)
+		return false
+	} else if err != nil {
+		slog.Error("failed to stamp, will retry later", "event_id", event.ID, "error", err)
+		notifyFailure("stamp", err)
+		if err := store.Save(event.ID, event, relays, nil); err != nil {
+			slog.Error("failed to save event for retrying", "event_id", event.ID, "error", err)
+		}
+		return false
+	}
+	publishIfComplete(ctx, store, pool, event.ID)
+
+	// it may have been confirmed and published already
+	if s.PostPendingNote && !s.DryRun && store.HasStamp(event.ID) {
+		eventRelay := bestRelay(relays)
+		postPendingNote(ctx, store, pool, event, eventRelay, publishRelays(eventRelay, relays))
+	}
+
+	return true
+}
+
+// checkID ensures the event id is a 32-byte hash and that it is actually the id of this event,
+// otherwise we would be stamping garbage
+func checkID(event nostr.Event) error {
+	if id, err := hex.DecodeString(event.ID); err != nil || len(id) != 32 {
+		return fmt.Errorf("'%s' is not a 32-byte hex hash", event.ID)
+	}
+	if computed := event.GetID(); computed != event.ID {
+		return fmt.Errorf("id doesn't match the event, should be %s", computed)
+	}
+	return nil
+}
+
+var (
+	allowedPubkeys map[string]bool
+	blockedPubkeys map[string]bool
+)
+
+// allowedAuthor tells if we should stamp events from this pubkey according to ALLOWED_PUBKEYS and BLOCKED_PUBKEYS
+func allowedAuthor(pubkey string) bool {
+	if blockedPubkeys[pubkey] {
+		return false
+	}
+	return len(allowedPubkeys) == 0 || allowedPubkeys[pubkey]
+}
+
+// allowedList is ALLOWED_PUBKEYS as a filter, so relays don't even send us the others
+func allowedList() []string {
+	if len(allowedPubkeys) == 0 {
+		return nil
+	}
+	list := make([]string, 0, len(allowedPubkeys))
+	for pubkey := range allowedPubkeys {
+		list = append(list, pubkey)
+	}
+	return list
+}
+
+// parsePubkeys takes a list of hex or npub pubkeys and returns the hex ones as a set
+func parsePubkeys(list []string) (map[string]bool, error) {
+	pubkeys := make(map[string]bool, len(list))
+	for _, pk := range list {
+		pk = strings.TrimSpace(pk)
+		if strings.HasPrefix(pk, "npub1") {
+			prefix, value, err := nip19.Decode(pk)
+			if err != nil || prefix != "npub" {
+				return nil, fmt.Errorf("invalid npub '%s'", pk)
+			}
+			pk = value.(string)
+		}
+		if b, err := hex.DecodeString(pk); err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("invalid pubkey '%s'", pk)
+		}
+		pubkeys[strings.ToLower(pk)] = true
+	}
+	return pubkeys, nil
+}
+
+// hasAttestation checks if someone (one of authors, if given) has already published a kind-1040 for the
+// given event id and digest
+func hasAttestation(ctx context.Context, pool *RelayPool, id string, digest []byte, authors []string, relays []string) bool {
+	_, found := findAttestation(ctx, pool, id, digest, authors, relays)
+	return found
+}
+
+// findAttestation is hasAttestation that also returns the attestation it found
+func findAttestation(ctx context.Context, pool *RelayPool, id string, digest []byte, authors []string, relays []string) (nostr.IncomingEvent, bool) {
+	ctx, cancel := context.WithTimeout(ctx, EXISTING_CHECK_TIMEOUT)
+	defer cancel()
+
+	for ie := range pool.SubManyEose(ctx, relays, nostr.Filters{
+		{
+			Kinds:   []int{1040},
+			Authors: authors,
+			Tags:    nostr.TagMap{"e": []string{id}},
+		},
+	}) {
+		data, err := base64.StdEncoding.DecodeString(ie.Content)
+		if err != nil {
+			continue
+		}
+		ots, err := opentimestamps.ReadFromFile(data)
+		if err != nil || !bytes.Equal(ots.Digest, digest) {
+			continue
+		}
+		return ie, true
+	}
+
+	return nostr.IncomingEvent{}, false
+}
+
+// ids of the events (or stamp keys) currently being stamped
+var stamping sync.Map
+
+// errStampInFlight is what we get when the same digest is already being stamped, the stamp will be there
+// once that finishes
+var errStampInFlight = errors.New("already being stamped")
+
+// stampEvent stamps the event id on the calendar servers and saves the ots file together with the event
+func stampEvent(ctx context.Context, store StampStore, event nostr.Event, relays []string) error {
+	if err := checkID(event); err != nil {
+		return err
+	}
+	id, _ := hex.DecodeString(event.ID)
+	var digest [32]byte
+	copy(digest[:], id)
+	return stampDigest(ctx, store, event.ID, digest, event, relays)
+}
+
+// contentKey is the hex sha256 of the event content, we store content stamps under it
+func contentKey(event nostr.Event) string {
+	digest := sha256.Sum256([]byte(event.Content))
+	return hex.EncodeToString(digest[:])
+}
+
+// stampContent is like stampEvent but stamps the hash of the event content, for tools that only have that.
+// events with the same content share the same stamp.
+func stampContent(ctx context.Context, store StampStore, event nostr.Event, relays []string) error {
+	digest := sha256.Sum256([]byte(event.Content))
+	return stampDigest(ctx, store, hex.EncodeToString(digest[:]), digest, event, relays)
+}
+
+// stampDigest stamps digest on the calendar servers and saves the ots file under key together with the event
+func stampDigest(ctx context.Context, store StampStore, key string, digest [32]byte, event nostr.Event, relays []string) error {
+	// the same event may come from many places at the same time
+	if _, already := stamping.LoadOrStore(key, struct{}{}); already {
+		return errStampInFlight
+	}
+	defer stamping.Delete(key)
+
+	if store.HasStamp(key) {
+		slog.Debug("stamp already exists", "event_id", event.ID)
+		return nil
+	}
+
+	seqs, recent := recentStamp(digest)
+	if recent {
+		slog.Debug("digest was stamped recently, reusing it", "event_id", event.ID, "digest", hex.EncodeToString(digest[:]))
+	} else {
+		var err error
+		seqs, err = requestStamp(ctx, digest)
+		if errors.Is(err, errStampRefused) {
+			return err
+		}
+		if len(seqs) == 0 {
+			return fmt.Errorf("failed to stamp on all calendars")
+		}
+		if len(seqs) < s.MinCalendars {
+			return fmt.Errorf("only %d calendars stamped, %d required", len(seqs), s.MinCalendars)
+		}
+		rememberStamp(digest, seqs)
+	}
+
+	file := opentimestamps.File{Digest: digest[:], Sequences: seqs}
+	if err := store.Save(key, event, relays, file.SerializeToFile()); err != nil {
+		return fmt.Errorf("failed to save stamp: %w", err)
+	}
+
+	slog.Info("saved stamp", "event_id", event.ID)
+	writeSummary(key, event, fmt.Sprintf("pending on %d calendars since %s", len(seqs), time.Now().UTC().Format(time.RFC3339)))
+	stampsTotal.Inc()
+	markStamped()
+	pendingTimestamps.Inc()
+	return nil
+}
+
+// digests we've stamped in the last RECENT_STAMP_WINDOW, so the same content coming again after its stamp
+// was published and deleted doesn't go to the calendars again
+var recentStamps = struct {
+	sync.Mutex
+	stamps map[[32]byte]recentSeqs
+}{stamps: make(map[[32]byte]recentSeqs)}
+
+type recentSeqs struct {
+	seqs []opentimestamps.Sequence
+	at   time.Time
+}
+
+func recentStamp(digest [32]byte) ([]opentimestamps.Sequence, bool) {
+	recentStamps.Lock()
+	defer recentStamps.Unlock()
+	recent, ok := recentStamps.stamps[digest]
+	if !ok || time.Since(recent.at) > RECENT_STAMP_WINDOW {
+		return nil, false
+	}
+	return recent.seqs, true
+}
+
+func rememberStamp(digest [32]byte, seqs []opentimestamps.Sequence) {
+	recentStamps.Lock()
+	defer recentStamps.Unlock()
+	for d, recent := range recentStamps.stamps {
+		if time.Since(recent.at) > RECENT_STAMP_WINDOW {
+			delete(recentStamps.stamps, d)
+		}
+	}
+	recentStamps.stamps[digest] = recentSeqs{seqs, time.Now()}
+}
+
+// stampOnCalendars submits the digest to all configured calendars at the same time and returns
+// the sequences from the ones that succeeded, so a single calendar being down doesn't matter.
+// if all of them failed permanently it returns errStampRefused.
+func stampOnCalendars(ctx context.Context, digest [32]byte) ([]opentimestamps.Sequence, error) {
+	seqs := make([]opentimestamps.Sequence, 0, len(s.Calendars))
+	refused := 0
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	wg.Add(len(s.Calendars))
+
+	for _, calendar := range s.Calendars {
+		go func(calendar string) {
+			defer wg.Done()
+
+			var seq opentimestamps.Sequence
+			var permanent error
+			err := retry(ctx, s.StampAttempts, s.StampRetryDelay, func() (err error) {
+				// wait for our turn instead of hammering the calendars
+				if err := stampLimiter.Wait(ctx); err != nil {
+					return err
+				}
+				select {
+				case calendarSlots <- struct{}{}:
+					defer func() { <-calendarSlots }()
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+
+				ctx, cancel := context.WithTimeout(ctx, s.StampTimeout)
+				defer cancel()
+				start := time.Now()
+				seq, err = timestamper.Stamp(ctx, calendar, digest)
+				observeCalendar(calendar, time.Since(start), err)
+				if err != nil {
+					stampErrorsTotal.WithLabelValues(calendar, stampErrorType(err)).Inc()
+				}
+				if err != nil && permanentStampError(err) {
+					// stop retrying, this calendar won't take it
+					permanent = err
+					return nil
+				}
+				return err
+			})
+			if err == nil && permanent != nil {
+				err = permanent
+				mu.Lock()
+				refused++
+				mu.Unlock()
+			}
+			if err != nil {
+				slog.Warn("failed to stamp", "calendar", calendar, "error_type", stampErrorType(err), "error", err)
+				stampFailuresTotal.Inc()
+				return
+			}
+
+			mu.Lock()
+			seqs = append(seqs, seq)
+			mu.Unlock()
+		}(calendar)
+	}
+
+	wg.Wait()
+	if len(seqs) == 0 && refused > 0 && refused == len(s.Calendars) {
+		return nil, errStampRefused
+	}
+	return seqs, nil
+}
+
+// retry calls fn up to attempts times, doubling the delay between attempts, until it succeeds
+func retry(ctx context.Context, attempts int, delay time.Duration, fn func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			slog.Debug("retrying", "attempt", i+1, "delay", delay.String(), "error", err)
+			if !sleep(ctx, delay) {
+				return ctx.Err()
+			}
+			delay *= 2
+		}
+
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// retryLoop calls retryUnstamped every UPGRADE_INTERVAL, for when there is no upgrade loop doing it
+func retryLoop(ctx context.Context, store StampStore) {
+	for sleep(ctx, s.UpgradeInterval) {
+		retryUnstamped(ctx, store)
+	}
+}
+
+// retryUnstamped tries again to stamp the events that were saved without an ots,
+// giving up on them after MAX_STAMP_RETRIES
+func retryUnstamped(ctx context.Context, store StampStore) {
+	ids, err := store.UnstampedIDs()
+	if err != nil {
+		slog.Error("error listing unstamped events", "error", err)
+		return
+	}
+
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+
+		attempts, err := store.AddStampAttempt(id)
+		if err != nil {
+			slog.Error("failed to record stamp attempt", "event_id", id, "error", err)
+			continue
+		}
+		if attempts > s.MaxStampRetries {
+			slog.Error("giving up on stamping event", "event_id", id, "attempts", attempts-1)
+			store.Delete(id)
+			continue
+		}
+
+		event, relays, _, err := store.Load(id)
+		if err != nil {
+			slog.Error("error loading unstamped event", "event_id", id, "error", err)
+			continue
+		}
+
+		slog.Info("retrying to stamp", "event_id", id, "attempt", attempts)
+		stamp := stampEvent
+		if id != event.ID {
+			// this is a content stamp
+			stamp = stampContent
+		}
+		if err := stamp(ctx, store, event, relays); errors.Is(err, errStampInFlight) {
+			slog.Debug("already being stamped", "event_id", id)
+		} else if errors.Is(err, errStampRefused) {
+			// the calendars will never take it, no point in waiting for MAX_STAMP_RETRIES
+			slog.Error("giving up on stamping event", "event_id", id, "attempts", attempts, "error", err)
+			if err := store.MarkFailed(id); err != nil {
+				slog.Error("failed to mark as failed", "event_id", id, "error", err)
+			}
+		} else if err != nil {
+			slog.Warn("failed to stamp again", "event_id", id, "error", err)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/opentimestamps"
+)
+
+// fakeTimestamper counts the stamps it's asked for and answers with a pending attestation, or with err.
+// if release is set it waits for it before answering.
+type fakeTimestamper struct {
+	mu      sync.Mutex
+	calls   int
+	err     error
+	release chan struct{}
+}
+
+func (ft *fakeTimestamper) Stamp(ctx context.Context, calendar string, digest [32]byte) (opentimestamps.Sequence, error) {
+	ft.mu.Lock()
+	ft.calls++
+	ft.mu.Unlock()
+	if ft.release != nil {
+		<-ft.release
+	}
+	if ft.err != nil {
+		return nil, ft.err
+	}
+	return opentimestamps.Sequence{
+		{Attestation: &opentimestamps.Attestation{CalendarServerURL: calendar}},
+	}, nil
+}
+
+func (ft *fakeTimestamper) UpgradeSequence(ctx context.Context, seq opentimestamps.Sequence, digest []byte) (opentimestamps.Sequence, error) {
+	return nil, errors.New("not upgraded yet")
+}
+
+func (ft *fakeTimestamper) count() int {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.calls
+}
+
+// useTimestamper replaces the timestamper for the duration of the test
+func useTimestamper(t *testing.T, ts Timestamper) {
+	previous := timestamper
+	timestamper = ts
+	t.Cleanup(func() { timestamper = previous })
+}
+
+// testEvent is a signed event with the given content
+func testEvent(t *testing.T, content string) nostr.Event {
+	t.Helper()
+	event := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      1,
+		Tags:      nostr.Tags{{"t", "prediction"}},
+		Content:   content,
+	}
+	if err := event.Sign(nostr.GeneratePrivateKey()); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestDuplicateEventIsStampedOnce(t *testing.T) {
+	for _, storage := range []string{"files", "sqlite"} {
+		t.Run(storage, func(t *testing.T) {
+			setup(t)
+			if storage == "sqlite" {
+				sqlite, err := NewSQLiteStore(filepath.Join(s.DataDir, "stamps.sqlite"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				store = sqlite
+			}
+			calendar := newMockCalendar(t)
+			s.Calendars = []string{calendar.url}
+			event := testEvent(t, "duplicate")
+
+			// the same event coming from two relays
+			for _, relay := range []string{"wss://one.example.com", "wss://two.example.com"} {
+				if err := stampEvent(context.Background(), store, event, []string{relay}); err != nil {
+					t.Fatalf("failed to stamp: %s", err)
+				}
+			}
+
+			if n := calendar.stampCount(); n != 1 {
+				t.Errorf("expected a single stamp, got %d", n)
+			}
+			if !store.HasStamp(event.ID) {
+				t.Errorf("stamp wasn't saved")
+			}
+		})
+	}
+}
+
+func TestCheckID(t *testing.T) {
+	good := testEvent(t, "good")
+	wrong := good
+	wrong.Content = "changed"
+	other := testEvent(t, "other")
+
+	for _, tc := range []struct {
+		name  string
+		id    string
+		event nostr.Event
+		ok    bool
+	}{
+		{"good", good.ID, good, true},
+		{"content changed", wrong.ID, wrong, false},
+		{"id of another event", other.ID, good, false},
+		{"uppercase", strings.ToUpper(good.ID), good, false},
+		{"too short", good.ID[:62], good, false},
+		{"too long", good.ID + "00", good, false},
+		{"not hex", "zz" + good.ID[2:], good, false},
+		{"empty", "", good, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			event := tc.event
+			event.ID = tc.id
+			if err := checkID(event); (err == nil) != tc.ok {
+				t.Errorf("checkID returned %v", err)
+			}
+		})
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestStampGoesToEveryCalendar(t *testing.T) {
+	setup(t)
+	s.Calendars = []string{"https://a.example.com", "https://b.example.com"}
+	ft := &fakeTimestamper{}
+	useTimestamper(t, ft)
+
+	event := testEvent(t, "two calendars")
+	if err := stampEvent(context.Background(), store, event, []string{"wss://relay.example.com"}); err != nil {
+		t.Fatalf("failed to stamp: %s", err)
+	}
+	if n := ft.count(); n != 2 {
+		t.Errorf("expected a stamp on each calendar, got %d", n)
+	}
+	_, _, data, err := store.Load(event.ID)
+	if err != nil {
+		t.Fatalf("stamp wasn't saved: %s", err)
+	}
+	ots, err := opentimestamps.ReadFromFile(data)
+	if err != nil {
+		t.Fatalf("saved an invalid ots file: %s", err)
+	}
+	if len(ots.Sequences) != 2 {
+		t.Errorf("expected a sequence for each calendar, got %s", ots.Human())
+	}
+}
+
+func TestRefusedStampIsMarkedFailedRightAway(t *testing.T) {
+	setup(t)
+	ft := &fakeTimestamper{err: calendarStatusError{400}}
+	useTimestamper(t, ft)
+
+	event := testEvent(t, "refused")
+	if err := store.Save(event.ID, event, []string{"wss://relay.example.com"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	retryUnstamped(context.Background(), store)
+
+	if calls := ft.count(); calls != len(s.Calendars) {
+		t.Errorf("expected one stamp per calendar, got %d", calls)
+	}
+	if ids, _ := store.UnstampedIDs(); len(ids) != 0 {
+		t.Errorf("event is still waiting to be stamped: %v", ids)
+	}
+	if _, err := os.Stat(filepath.Join(s.DataDir, FAILED_SUBDIR, PREFIX_EVENT+event.ID+SUFFIX_EVENT)); err != nil {
+		t.Errorf("event wasn't moved to %s: %s", FAILED_SUBDIR, err)
+	}
+}
+
+func TestTransientStampErrorIsRetried(t *testing.T) {
+	setup(t)
+	s.StampAttempts = 1
+	ft := &fakeTimestamper{err: calendarStatusError{503}}
+	useTimestamper(t, ft)
+
+	event := testEvent(t, "unavailable")
+	if err := store.Save(event.ID, event, []string{"wss://relay.example.com"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	retryUnstamped(context.Background(), store)
+
+	if ids, _ := store.UnstampedIDs(); len(ids) != 1 {
+		t.Errorf("event should still be waiting to be stamped, got %v", ids)
+	}
+}
+
+func TestEventAlreadyBeingStampedIsSkipped(t *testing.T) {
+	setup(t)
+	s.SkipExisting = false
+	ft := &fakeTimestamper{release: make(chan struct{})}
+	useTimestamper(t, ft)
+	pool := NewRelayPool(context.Background())
+
+	// the same event coming from two relays at the same time
+	event := testEvent(t, "at the same time")
+	first := make(chan bool)
+	go func() {
+		first <- handleEvent(context.Background(), store, pool, event, []string{"wss://one.example.com"})
+	}()
+	for ft.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := stampEvent(context.Background(), store, event, []string{"wss://two.example.com"}); !errors.Is(err, errStampInFlight) {
+		t.Errorf("expected errStampInFlight, got %v", err)
+	}
+	if handleEvent(context.Background(), store, pool, event, []string{"wss://two.example.com"}) {
+		t.Errorf("counted as stamped while the other one was still stamping")
+	}
+	if ids, _ := store.UnstampedIDs(); len(ids) != 0 {
+		t.Errorf("saved for retrying: %v", ids)
+	}
+
+	close(ft.release)
+	if !<-first {
+		t.Errorf("the first one wasn't stamped")
+	}
+	if !store.HasStamp(event.ID) {
+		t.Errorf("stamp wasn't saved")
+	}
+}
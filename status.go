@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/opentimestamps"
+)
+
+// state is what we report on the status endpoint
+var state struct {
+	sync.Mutex
+	relays      map[string]*nostr.Relay
+	lastStamp   time.Time
+	lastUpgrade time.Time
+}
+
+func setRelay(url string, relay *nostr.Relay) {
+	state.Lock()
+	defer state.Unlock()
+	if state.relays == nil {
+		state.relays = make(map[string]*nostr.Relay)
+	}
+	state.relays[url] = relay
+}
+
+func connectedRelays() int {
+	state.Lock()
+	defer state.Unlock()
+	n := 0
+	for _, relay := range state.relays {
+		if relay != nil && relay.IsConnected() {
+			n++
+		}
+	}
+	return n
+}
+
+// reachableRelays counts the relays whose last connection attempt worked, even if they dropped us since,
+// out of all the ones we tried
+func reachableRelays() (reachable int, tried int) {
+	state.Lock()
+	defer state.Unlock()
+	for _, relay := range state.relays {
+		if relay != nil {
+			reachable++
+		}
+	}
+	return reachable, len(state.relays)
+}
+
+func relayStates() map[string]bool {
+	state.Lock()
+	defer state.Unlock()
+	states := make(map[string]bool, len(state.relays))
+	for url, relay := range state.relays {
+		states[url] = relay != nil && relay.IsConnected()
+	}
+	return states
+}
+
+func markStamped() {
+	state.Lock()
+	defer state.Unlock()
+	state.lastStamp = time.Now()
+}
+
+func markUpgraded() {
+	state.Lock()
+	defer state.Unlock()
+	state.lastUpgrade = time.Now()
+}
+
+func serveStatus(pool *RelayPool) {
+	slog.Info("serving status", "addr", s.StatusAddr)
+	if err := http.ListenAndServe(s.StatusAddr, statusMux(pool)); err != nil {
+		slog.Error("status server failed", "error", err)
+	}
+}
+
+func statusMux(pool *RelayPool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if s.Mode == "upgrade" {
+			// we only connect to relays to publish and they may close idle connections after that,
+			// so only complain when we needed them and couldn't get to any
+			if reachable, tried := reachableRelays(); tried > 0 && reachable == 0 {
+				http.Error(w, "couldn't connect to any relay", http.StatusServiceUnavailable)
+				return
+			}
+		} else if connectedRelays() == 0 {
+			http.Error(w, "not connected to any relay", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		pending, err := store.PendingIDs()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		state.Lock()
+		lastStamp, lastUpgrade := state.lastStamp, state.lastUpgrade
+		state.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Version           string          `json:"version"`
+			Commit            string          `json:"commit"`
+			Pubkey            string          `json:"pubkey"`
+			ConnectedRelays   int             `json:"connected_relays"`
+			Relays            map[string]bool `json:"relays"`
+			PendingTimestamps int             `json:"pending_timestamps"`
+			LastStamp         *time.Time      `json:"last_stamp"`
+			LastUpgrade       *time.Time      `json:"last_upgrade"`
+		}{
+			Version:           version,
+			Commit:            commit,
+			Pubkey:            botPubkey,
+			ConnectedRelays:   connectedRelays(),
+			Relays:            relayStates(),
+			PendingTimestamps: len(pending),
+			LastStamp:         timeOrNil(lastStamp),
+			LastUpgrade:       timeOrNil(lastUpgrade),
+		})
+	})
+
+	mux.HandleFunc("/attestation/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/attestation/")
+		if b, err := hex.DecodeString(id); err != nil || len(b) != 32 {
+			http.Error(w, "invalid event id", http.StatusBadRequest)
+			return
+		}
+
+		attestation, ok := lookupAttestation(r.Context(), pool, id)
+		if !ok {
+			http.Error(w, "no attestation for this event", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(attestation)
+	})
+	return mux
+}
+
+// attestationInfo is what we serve on /attestation/<event-id>
+type attestationInfo struct {
+	EventID     string       `json:"event_id"`
+	Status      string       `json:"status"` // pending, confirmed (but not published yet) or published
+	OTS         []byte       `json:"ots"`
+	BlockHeight uint64       `json:"block_height,omitempty"`
+	BlockHash   string       `json:"block_hash,omitempty"`
+	BlockTime   *time.Time   `json:"block_time,omitempty"`
+	Event       *nostr.Event `json:"event,omitempty"`
+	Relays      []string     `json:"relays,omitempty"` // where it was published
+}
+
+// setBlock fills in the block the timestamp is in, returns false if it isn't on bitcoin yet
+func (info *attestationInfo) setBlock(ctx context.Context, ots *opentimestamps.File) bool {
+	seqs := ots.GetBitcoinAttestedSequences()
+	if len(seqs) == 0 {
+		return false
+	}
+	info.BlockHeight = seqs[0].GetAttestation().BitcoinBlockHeight
+	if hash, header, err := blockAt(ctx, info.BlockHeight); err != nil {
+		slog.Warn("failed to get block", "event_id", info.EventID, "block_height", info.BlockHeight, "error", err)
+	} else {
+		info.BlockHash = hash.String()
+		info.BlockTime = timeOrNil(header.Timestamp.UTC())
+	}
+	return true
+}
+
+// lookupAttestation finds what we have for an event id: our record of having published it, a timestamp still
+// in the store or, for attestations published before we kept records, the kind-1040 we have on our relays
+func lookupAttestation(ctx context.Context, pool *RelayPool, id string) (attestationInfo, bool) {
+	info := attestationInfo{EventID: id, Status: "pending"}
+
+	if attestation, relays, err := store.LoadPublished(id); err == nil {
+		if data, err := base64.StdEncoding.DecodeString(attestation.Content); err == nil {
+			if ots, err := opentimestamps.ReadFromFile(data); err == nil {
+				info.Status = "published"
+				info.OTS = data
+				info.setBlock(ctx, ots)
+				info.Event = &attestation
+				info.Relays = relays
+				return info, true
+			}
+		}
+	}
+
+	if _, _, data, err := store.Load(id); err == nil && data != nil {
+		if ots, err := opentimestamps.ReadFromFile(data); err == nil {
+			info.OTS = data
+			if info.setBlock(ctx, ots) {
+				info.Status = "confirmed"
+			}
+			return info, true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, EXISTING_CHECK_TIMEOUT)
+	defer cancel()
+	for ie := range pool.SubManyEose(ctx, s.Relays, nostr.Filters{
+		{
+			Kinds:   []int{1040},
+			Authors: []string{botPubkey},
+			Tags:    nostr.TagMap{"e": []string{id}},
+		},
+	}) {
+		if ok, _ := ie.CheckSignature(); !ok || ie.PubKey != botPubkey {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(ie.Content)
+		if err != nil {
+			continue
+		}
+		ots, err := opentimestamps.ReadFromFile(data)
+		if err != nil {
+			continue
+		}
+		info.Status = "published"
+		info.OTS = data
+		info.setBlock(ctx, ots)
+		info.Event = ie.Event
+		return info, true
+	}
+
+	return info, false
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
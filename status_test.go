@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/opentimestamps"
+)
+
+func TestLookupAttestationHasBlock(t *testing.T) {
+	setup(t)
+	me := newMockEsplora(t, 800_000)
+	useEsplora(t, me)
+
+	event := testEvent(t, "confirmed")
+	digest := chainhash.Hash{}
+	copy(digest[:], mustHex(t, event.ID))
+	hash := me.setBlock(799_990, digest)
+
+	file := opentimestamps.File{Digest: digest[:], Sequences: []opentimestamps.Sequence{
+		{{Attestation: &opentimestamps.Attestation{BitcoinBlockHeight: 799_990}}},
+	}}
+	if err := store.Save(event.ID, event, nil, file.SerializeToFile()); err != nil {
+		t.Fatal(err)
+	}
+
+	info, ok := lookupAttestation(context.Background(), NewRelayPool(context.Background()), event.ID)
+	if !ok {
+		t.Fatal("attestation not found")
+	}
+	if info.Status != "confirmed" || info.BlockHeight != 799_990 {
+		t.Errorf("got status %s at %d", info.Status, info.BlockHeight)
+	}
+	if info.BlockHash != hash.String() {
+		t.Errorf("got block hash %s, expected %s", info.BlockHash, hash)
+	}
+	if info.BlockTime == nil || info.BlockTime.Unix() != 1231006505+799_990*600 {
+		t.Errorf("got block time %v", info.BlockTime)
+	}
+}
+
+func TestHealthzInUpgradeMode(t *testing.T) {
+	h := newHarness(t)
+	s.Mode = "upgrade"
+	resetRelayStates(t)
+
+	healthz := func() int {
+		w := httptest.NewRecorder()
+		statusMux(h.pool).ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+		return w.Code
+	}
+
+	// nothing to publish yet, so no relays either
+	if code := healthz(); code != http.StatusOK {
+		t.Errorf("got %d before needing any relay", code)
+	}
+
+	down := "ws://127.0.0.1:1"
+	if _, err := h.pool.EnsureRelay(down); err == nil {
+		t.Fatal("connected to a relay that is down")
+	}
+	if code := healthz(); code != http.StatusServiceUnavailable {
+		t.Errorf("got %d when no relay could be reached", code)
+	}
+
+	// publishing connects through the pool, and that's enough to pick it for tags too
+	event := testEvent(t, "upgrade only")
+	if published := publishToRelays(h.ctx, h.pool, event, []string{h.relay.url}); len(published) != 1 {
+		t.Fatalf("failed to publish")
+	}
+	if code := healthz(); code != http.StatusOK {
+		t.Errorf("got %d after publishing", code)
+	}
+	if best := bestRelay([]string{down, h.relay.url}); best != nostr.NormalizeURL(h.relay.url) {
+		t.Errorf("picked %s, expected the connected relay", best)
+	}
+}
+
+// resetRelayStates forgets the relays other tests connected to
+func resetRelayStates(t *testing.T) {
+	reset := func() {
+		state.Lock()
+		state.relays = nil
+		state.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/opentimestamps"
+)
+
+// StampStore is where we keep the events we've stamped while their attestations are pending
+type StampStore interface {
+	// Save with a nil ots records an event we failed to stamp, so it can be retried later.
+	// relays are the ones the event was seen on, in the order we saw it.
+	Save(id string, event nostr.Event, relays []string, ots []byte) error
+	Load(id string) (event nostr.Event, relays []string, ots []byte, err error)
+	Delete(id string) error
+
+	// HasStamp tells if we already have an ots for this id
+	HasStamp(id string) bool
+
+	// StampedAt is when we got the ots for this id
+	StampedAt(id string) (time.Time, error)
+
+	// PendingIDs are the ids that have an ots waiting to be upgraded
+	PendingIDs() ([]string, error)
+
+	// UnstampedIDs are the ids that were saved without an ots
+	UnstampedIDs() ([]string, error)
+
+	// MarkFailed takes a stamp out of the pending set for good, but keeps it around for inspection
+	MarkFailed(id string) error
+
+	// AddStampAttempt increments and returns the number of times we've tried to stamp this id
+	AddStampAttempt(id string) (int, error)
+
+	// SavePublished records the attestation we published for id and the relays that accepted it,
+	// these are kept after the stamp itself is deleted
+	SavePublished(id string, attestation nostr.Event, relays []string) error
+	LoadPublished(id string) (attestation nostr.Event, relays []string, err error)
+
+	// SavePendingNote records the "pending" note we posted for id so it can be deleted once it's confirmed,
+	// it goes away with Delete
+	SavePendingNote(id string, noteID string) error
+	PendingNote(id string) (noteID string, err error)
+
+	// LastSeen is the created_at of the newest event we've processed, so we can catch up after a restart
+	LastSeen() (nostr.Timestamp, error)
+	SetLastSeen(ts nostr.Timestamp) error
+}
+
+// FileStore keeps three files per event inside dir: the event, the relays it came from and the ots
+type FileStore struct {
+	dir string
+}
+
+var _ StampStore = FileStore{}
+
+func (fs FileStore) path(names ...string) string {
+	return filepath.Join(append([]string{fs.dir}, names...)...)
+}
+
+func (fs FileStore) Save(id string, event nostr.Event, relays []string, ots []byte) error {
+	if err := writeFileAtomic(fs.path(PREFIX_EVENT+id+SUFFIX_EVENT), compress(encodeEvent(event))); err != nil {
+		return fmt.Errorf("failed to save event file: %w", err)
+	}
+	if err := writeFileAtomic(fs.path(PREFIX_RELAY+id+SUFFIX_RELAY), []byte(strings.Join(relays, "\n"))); err != nil {
+		return fmt.Errorf("failed to save event relay file: %w", err)
+	}
+	if ots != nil {
+		// the modification time is used as the stamp time, so we keep it when updating the ots
+		path := fs.path(PREFIX_OTS + id + SUFFIX_OTS)
+		info, statErr := os.Stat(path)
+		if err := writeFileAtomic(path, compress(ots)); err != nil {
+			return fmt.Errorf("failed to save stamp file: %w", err)
+		}
+		// an ots that doesn't parse would be stuck failing to upgrade forever, better to stamp it again
+		if written, err := readBlob(path); err != nil {
+			os.Remove(path)
+			return fmt.Errorf("failed to read stamp file back: %w", err)
+		} else if _, err := opentimestamps.ReadFromFile(written); err != nil {
+			os.Remove(path)
+			return fmt.Errorf("stamp file is corrupt after saving: %w", err)
+		}
+		if statErr == nil {
+			os.Chtimes(path, time.Now(), info.ModTime())
+		}
+	}
+	return nil
+}
+
+func (fs FileStore) Load(id string) (event nostr.Event, relays []string, ots []byte, err error) {
+	ots, err = readBlob(fs.path(PREFIX_OTS + id + SUFFIX_OTS))
+	if os.IsNotExist(err) {
+		ots = nil
+	} else if err != nil {
+		return event, nil, nil, fmt.Errorf("error reading ots: %w", err)
+	}
+
+	if eventb, err := readBlob(fs.path(PREFIX_EVENT + id + SUFFIX_EVENT)); err != nil {
+		return event, nil, nil, fmt.Errorf("error reading event: %w", err)
+	} else if event, err = decodeEvent(eventb); err != nil {
+		return event, nil, nil, fmt.Errorf("error parsing event: %w", err)
+	}
+
+	if relayb, err := os.ReadFile(fs.path(PREFIX_RELAY + id + SUFFIX_RELAY)); err != nil {
+		return event, nil, nil, fmt.Errorf("error reading event relays: %w", err)
+	} else {
+		relays = strings.Fields(string(relayb))
+	}
+
+	return event, relays, ots, nil
+}
+
+func (fs FileStore) Delete(id string) error {
+	os.Remove(fs.path(PREFIX_OTS + id + SUFFIX_OTS))
+	os.Remove(fs.path(PREFIX_RELAY + id + SUFFIX_RELAY))
+	os.Remove(fs.path(PREFIX_EVENT + id + SUFFIX_EVENT))
+	os.Remove(fs.path(PREFIX_ATTEMPTS + id + SUFFIX_ATTEMPTS))
+	os.Remove(fs.path(PREFIX_NOTE + id + SUFFIX_NOTE))
+	return nil
+}
+
+func (fs FileStore) HasStamp(id string) bool {
+	_, err := os.Stat(fs.path(PREFIX_OTS + id + SUFFIX_OTS))
+	return err == nil
+}
+
+func (fs FileStore) StampedAt(id string) (time.Time, error) {
+	info, err := os.Stat(fs.path(PREFIX_OTS + id + SUFFIX_OTS))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (fs FileStore) MarkFailed(id string) error {
+	if err := os.MkdirAll(fs.path(FAILED_SUBDIR), 0755); err != nil {
+		return err
+	}
+	for _, name := range []string{
+		PREFIX_OTS + id + SUFFIX_OTS,
+		PREFIX_EVENT + id + SUFFIX_EVENT,
+		PREFIX_RELAY + id + SUFFIX_RELAY,
+		PREFIX_ATTEMPTS + id + SUFFIX_ATTEMPTS,
+		PREFIX_NOTE + id + SUFFIX_NOTE,
+	} {
+		if err := os.Rename(fs.path(name), fs.path(FAILED_SUBDIR, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs FileStore) PendingIDs() ([]string, error) {
+	files, err := os.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(files)/3)
+	for _, file := range files {
+		filename := file.Name()
+		if strings.HasPrefix(filename, PREFIX_OTS) && strings.HasSuffix(filename, SUFFIX_OTS) {
+			ids = append(ids, filename[len(PREFIX_OTS):len(filename)-len(SUFFIX_OTS)])
+		}
+	}
+	return ids, nil
+}
+
+func (fs FileStore) UnstampedIDs() ([]string, error) {
+	files, err := os.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, 10)
+	for _, file := range files {
+		filename := file.Name()
+		if strings.HasPrefix(filename, PREFIX_EVENT) && strings.HasSuffix(filename, SUFFIX_EVENT) {
+			id := filename[len(PREFIX_EVENT) : len(filename)-len(SUFFIX_EVENT)]
+			if _, err := os.Stat(fs.path(PREFIX_OTS + id + SUFFIX_OTS)); os.IsNotExist(err) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (fs FileStore) AddStampAttempt(id string) (int, error) {
+	attempts, err := fs.stampAttempts(id)
+	if err != nil {
+		return 0, err
+	}
+
+	attempts++
+	if err := writeFileAtomic(fs.path(PREFIX_ATTEMPTS+id+SUFFIX_ATTEMPTS), []byte(strconv.Itoa(attempts))); err != nil {
+		return 0, err
+	}
+	return attempts, nil
+}
+
+func (fs FileStore) stampAttempts(id string) (int, error) {
+	b, err := os.ReadFile(fs.path(PREFIX_ATTEMPTS + id + SUFFIX_ATTEMPTS))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	attempts, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return attempts, nil
+}
+
+// publishedRecord is what we keep about attestations after publishing them
+type publishedRecord struct {
+	Attestation nostr.Event `json:"attestation"`
+	Relays      []string    `json:"relays"`
+}
+
+func (fs FileStore) SavePublished(id string, attestation nostr.Event, relays []string) error {
+	b, err := json.Marshal(publishedRecord{attestation, relays})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fs.path(PREFIX_PUBLISHED+id+SUFFIX_PUBLISHED), compress(b))
+}
+
+func (fs FileStore) LoadPublished(id string) (attestation nostr.Event, relays []string, err error) {
+	b, err := readBlob(fs.path(PREFIX_PUBLISHED + id + SUFFIX_PUBLISHED))
+	if err != nil {
+		return attestation, nil, err
+	}
+	var record publishedRecord
+	if err := json.Unmarshal(b, &record); err != nil {
+		return attestation, nil, fmt.Errorf("error parsing published record: %w", err)
+	}
+	return record.Attestation, record.Relays, nil
+}
+
+func (fs FileStore) SavePendingNote(id string, noteID string) error {
+	return writeFileAtomic(fs.path(PREFIX_NOTE+id+SUFFIX_NOTE), []byte(noteID))
+}
+
+func (fs FileStore) PendingNote(id string) (string, error) {
+	b, err := os.ReadFile(fs.path(PREFIX_NOTE + id + SUFFIX_NOTE))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (fs FileStore) LastSeen() (nostr.Timestamp, error) {
+	b, err := os.ReadFile(fs.path(FILE_LAST_SEEN))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	ts, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	return nostr.Timestamp(ts), err
+}
+
+func (fs FileStore) SetLastSeen(ts nostr.Timestamp) error {
+	return writeFileAtomic(fs.path(FILE_LAST_SEEN), []byte(strconv.FormatInt(int64(ts), 10)))
+}
+
+// writeFileAtomic writes to a temporary file first and then renames it, so a crash or shutdown
+// in the middle of a write never leaves a half-written file at path.
+// the temporary file is read back before the rename and written again if it doesn't match.
+// each write gets its own temporary file, so concurrent writes to the same path don't mix.
+func writeFileAtomic(path string, data []byte) error {
+	var err error
+	for i := 0; i < WRITE_ATTEMPTS; i++ {
+		var f *os.File
+		if f, err = os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp"); err == nil {
+			if err = writeAndCheck(f, data); err == nil {
+				return os.Rename(f.Name(), path)
+			}
+			os.Remove(f.Name())
+		}
+		if errors.Is(err, syscall.ENOSPC) {
+			return fmt.Errorf("disk is full: %w", err)
+		}
+	}
+	return err
+}
+
+func writeAndCheck(f *os.File, data []byte) error {
+	path := f.Name()
+	// CreateTemp makes it 0600
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	written, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(written, data) {
+		return fmt.Errorf("%s has %d bytes after writing %d", path, len(written), len(data))
+	}
+	return nil
+}
+
+// binaryEvent is how events are stored with EVENT_ENCODING=gob, the hex fields are kept as bytes
+type binaryEvent struct {
+	ID        []byte
+	PubKey    []byte
+	Sig       []byte
+	CreatedAt int64
+	Kind      int
+	Tags      [][]string
+	Content   string
+}
+
+// encodeEvent is the event as json or gob according to EVENT_ENCODING
+func encodeEvent(event nostr.Event) []byte {
+	if s.EventEncoding != "gob" {
+		return []byte(event.String())
+	}
+	be := binaryEvent{CreatedAt: int64(event.CreatedAt), Kind: event.Kind, Content: event.Content}
+	be.ID, _ = hex.DecodeString(event.ID)
+	be.PubKey, _ = hex.DecodeString(event.PubKey)
+	be.Sig, _ = hex.DecodeString(event.Sig)
+	be.Tags = make([][]string, len(event.Tags))
+	for i, tag := range event.Tags {
+		be.Tags[i] = tag
+	}
+	buf := bytes.Buffer{}
+	gob.NewEncoder(&buf).Encode(be)
+	return buf.Bytes()
+}
+
+// decodeEvent reads events stored with either encoding, so EVENT_ENCODING can be changed at any time
+func decodeEvent(data []byte) (event nostr.Event, err error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		err = json.Unmarshal(data, &event)
+		return event, err
+	}
+	var be binaryEvent
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&be); err != nil {
+		return event, err
+	}
+	event = nostr.Event{
+		ID:        hex.EncodeToString(be.ID),
+		PubKey:    hex.EncodeToString(be.PubKey),
+		Sig:       hex.EncodeToString(be.Sig),
+		CreatedAt: nostr.Timestamp(be.CreatedAt),
+		Kind:      be.Kind,
+		Tags:      make(nostr.Tags, len(be.Tags)),
+		Content:   be.Content,
+	}
+	for i, tag := range be.Tags {
+		event.Tags[i] = tag
+	}
+	return event, nil
+}
+
+// compress gzips data when COMPRESS is set
+func compress(data []byte) []byte {
+	if !s.Compress {
+		return data
+	}
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// readBlob reads a file that may or may not have been compressed, so COMPRESS can be turned on and off
+func readBlob(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil || !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return data, err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// JSONStore keeps a single json file per event inside dir with everything we know about it
+type JSONStore struct {
+	dir string
+}
+
+var _ StampStore = JSONStore{}
+
+// stampRecord is what goes inside each file, the ots is base64-encoded by encoding/json
+type stampRecord struct {
+	Event         nostr.Event `json:"event"`
+	Relays        []string    `json:"relays"`
+	OTS           []byte      `json:"ots,omitempty"`
+	StampedAt     int64       `json:"stamped_at,omitempty"`
+	StampAttempts int         `json:"stamp_attempts,omitempty"`
+	PendingNote   string      `json:"pending_note,omitempty"`
+}
+
+func (js JSONStore) path(names ...string) string {
+	return filepath.Join(append([]string{js.dir}, names...)...)
+}
+
+func (js JSONStore) read(id string) (stampRecord, error) {
+	var record stampRecord
+	b, err := readBlob(js.path(PREFIX_STAMP + id + SUFFIX_STAMP))
+	if err != nil {
+		return record, err
+	}
+	if err := json.Unmarshal(b, &record); err != nil {
+		return record, fmt.Errorf("error parsing record: %w", err)
+	}
+	return record, nil
+}
+
+func (js JSONStore) write(id string, record stampRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(js.path(PREFIX_STAMP+id+SUFFIX_STAMP), compress(b))
+}
+
+func (js JSONStore) Save(id string, event nostr.Event, relays []string, ots []byte) error {
+	record, err := js.read(id)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	record.Event = event
+	record.Relays = relays
+	record.OTS = ots
+	if ots != nil && record.StampedAt == 0 {
+		record.StampedAt = time.Now().Unix()
+	}
+	if err := js.write(id, record); err != nil {
+		return fmt.Errorf("failed to save record: %w", err)
+	}
+	return nil
+}
+
+func (js JSONStore) Load(id string) (event nostr.Event, relays []string, ots []byte, err error) {
+	record, err := js.read(id)
+	if err != nil {
+		return event, nil, nil, fmt.Errorf("error reading record: %w", err)
+	}
+	return record.Event, record.Relays, record.OTS, nil
+}
+
+func (js JSONStore) Delete(id string) error {
+	os.Remove(js.path(PREFIX_STAMP + id + SUFFIX_STAMP))
+	return nil
+}
+
+func (js JSONStore) HasStamp(id string) bool {
+	record, err := js.read(id)
+	return err == nil && record.OTS != nil
+}
+
+func (js JSONStore) StampedAt(id string) (time.Time, error) {
+	record, err := js.read(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if record.StampedAt == 0 {
+		return time.Time{}, fmt.Errorf("not stamped")
+	}
+	return time.Unix(record.StampedAt, 0), nil
+}
+
+func (js JSONStore) MarkFailed(id string) error {
+	if err := os.MkdirAll(js.path(FAILED_SUBDIR), 0755); err != nil {
+		return err
+	}
+	name := PREFIX_STAMP + id + SUFFIX_STAMP
+	if err := os.Rename(js.path(name), js.path(FAILED_SUBDIR, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (js JSONStore) PendingIDs() ([]string, error) {
+	return js.filterIDs(func(record stampRecord) bool { return record.OTS != nil })
+}
+
+func (js JSONStore) UnstampedIDs() ([]string, error) {
+	return js.filterIDs(func(record stampRecord) bool { return record.OTS == nil })
+}
+
+func (js JSONStore) AddStampAttempt(id string) (int, error) {
+	record, err := js.read(id)
+	if err != nil {
+		return 0, err
+	}
+	record.StampAttempts++
+	if err := js.write(id, record); err != nil {
+		return 0, err
+	}
+	return record.StampAttempts, nil
+}
+
+func (js JSONStore) SavePendingNote(id string, noteID string) error {
+	record, err := js.read(id)
+	if err != nil {
+		return err
+	}
+	record.PendingNote = noteID
+	return js.write(id, record)
+}
+
+func (js JSONStore) PendingNote(id string) (string, error) {
+	record, err := js.read(id)
+	if err != nil {
+		return "", err
+	}
+	if record.PendingNote == "" {
+		return "", os.ErrNotExist
+	}
+	return record.PendingNote, nil
+}
+
+// published records and the last seen timestamp are kept in the same files the other store uses
+func (js JSONStore) SavePublished(id string, attestation nostr.Event, relays []string) error {
+	return FileStore{js.dir}.SavePublished(id, attestation, relays)
+}
+
+func (js JSONStore) LoadPublished(id string) (nostr.Event, []string, error) {
+	return FileStore{js.dir}.LoadPublished(id)
+}
+
+func (js JSONStore) LastSeen() (nostr.Timestamp, error) {
+	return FileStore{js.dir}.LastSeen()
+}
+
+func (js JSONStore) SetLastSeen(ts nostr.Timestamp) error {
+	return FileStore{js.dir}.SetLastSeen(ts)
+}
+
+func (js JSONStore) filterIDs(match func(stampRecord) bool) ([]string, error) {
+	files, err := os.ReadDir(js.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(files))
+	for _, file := range files {
+		filename := file.Name()
+		if !strings.HasPrefix(filename, PREFIX_STAMP) || !strings.HasSuffix(filename, SUFFIX_STAMP) {
+			continue
+		}
+		id := filename[len(PREFIX_STAMP) : len(filename)-len(SUFFIX_STAMP)]
+		if record, err := js.read(id); err == nil && match(record) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// SQLiteStore keeps everything in a single table keyed by the event id
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+var _ StampStore = (*SQLiteStore)(nil)
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	// wait for the lock instead of failing when another instance is writing
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite doesn't like concurrent writers
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS stamps (
+  id text NOT NULL PRIMARY KEY,
+  event text NOT NULL,
+  relay text NOT NULL,
+  ots blob,
+  stamp_attempts integer NOT NULL DEFAULT 0
+)
+    `); err != nil {
+		return nil, fmt.Errorf("failed to create table: %w", err)
+	}
+	if _, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS state (
+  key text NOT NULL PRIMARY KEY,
+  value text NOT NULL
+)
+    `); err != nil {
+		return nil, fmt.Errorf("failed to create state table: %w", err)
+	}
+
+	if _, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS published (
+  id text NOT NULL PRIMARY KEY,
+  attestation text NOT NULL,
+  relays text NOT NULL
+)
+    `); err != nil {
+		return nil, fmt.Errorf("failed to create published table: %w", err)
+	}
+
+	// columns added later, these fail harmlessly when the column already exists
+	for _, stmt := range []string{
+		`ALTER TABLE stamps ADD COLUMN stamped_at integer`,
+		`ALTER TABLE stamps ADD COLUMN failed integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE stamps ADD COLUMN pending_note text`,
+	} {
+		db.Exec(stmt)
+	}
+
+	// rows stamped before stamped_at existed get the event's created_at, or now if we can't read it
+	if _, err := db.Exec(`
+UPDATE stamps SET stamped_at = coalesce(
+  CASE WHEN typeof(event) = 'text' AND json_valid(event) THEN json_extract(event, '$.created_at') END,
+  unixepoch()
+) WHERE stamped_at IS NULL AND ots IS NOT NULL
+    `); err != nil {
+		return nil, fmt.Errorf("failed to fill in stamped_at: %w", err)
+	}
+
+	return &SQLiteStore{db}, nil
+}
+
+// relays are saved in the relay column separated by newlines
+func (ss *SQLiteStore) Save(id string, event nostr.Event, relays []string, ots []byte) error {
+	var stampedAt *int64
+	if ots != nil {
+		now := time.Now().Unix()
+		stampedAt = &now
+	}
+	_, err := ss.db.Exec(`INSERT INTO stamps (id, event, relay, ots, stamped_at) VALUES (?, ?, ?, ?, ?)
+    ON CONFLICT (id) DO UPDATE SET event = excluded.event, relay = excluded.relay, ots = excluded.ots,
+      stamped_at = coalesce(stamps.stamped_at, excluded.stamped_at), failed = 0`,
+		id, eventColumn(event), strings.Join(relays, "\n"), ots, stampedAt)
+	return err
+}
+
+// eventColumn keeps json events as text so they can still be read with the sqlite3 shell
+func eventColumn(event nostr.Event) any {
+	if s.EventEncoding == "gob" {
+		return encodeEvent(event)
+	}
+	return event.String()
+}
+
+func (ss *SQLiteStore) Load(id string) (event nostr.Event, relays []string, ots []byte, err error) {
+	var eventb []byte
+	var relay string
+	if err := ss.db.QueryRow(`SELECT event, relay, ots FROM stamps WHERE id = ?`, id).
+		Scan(&eventb, &relay, &ots); err != nil {
+		return event, nil, nil, fmt.Errorf("error reading stamp: %w", err)
+	}
+	if event, err = decodeEvent(eventb); err != nil {
+		return event, nil, nil, fmt.Errorf("error parsing event: %w", err)
+	}
+	return event, strings.Fields(relay), ots, nil
+}
+
+func (ss *SQLiteStore) Delete(id string) error {
+	_, err := ss.db.Exec(`DELETE FROM stamps WHERE id = ?`, id)
+	return err
+}
+
+func (ss *SQLiteStore) HasStamp(id string) bool {
+	var exists bool
+	err := ss.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM stamps WHERE id = ? AND ots IS NOT NULL AND failed = 0)`, id).Scan(&exists)
+	return err == nil && exists
+}
+
+func (ss *SQLiteStore) StampedAt(id string) (time.Time, error) {
+	var stampedAt int64
+	if err := ss.db.QueryRow(`SELECT stamped_at FROM stamps WHERE id = ? AND stamped_at IS NOT NULL`, id).
+		Scan(&stampedAt); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(stampedAt, 0), nil
+}
+
+func (ss *SQLiteStore) PendingIDs() ([]string, error) {
+	return ss.queryIDs(`SELECT id FROM stamps WHERE ots IS NOT NULL AND failed = 0`)
+}
+
+func (ss *SQLiteStore) UnstampedIDs() ([]string, error) {
+	return ss.queryIDs(`SELECT id FROM stamps WHERE ots IS NULL AND failed = 0`)
+}
+
+func (ss *SQLiteStore) MarkFailed(id string) error {
+	_, err := ss.db.Exec(`UPDATE stamps SET failed = 1 WHERE id = ?`, id)
+	return err
+}
+
+func (ss *SQLiteStore) AddStampAttempt(id string) (int, error) {
+	var attempts int
+	err := ss.db.QueryRow(`UPDATE stamps SET stamp_attempts = stamp_attempts + 1 WHERE id = ? RETURNING stamp_attempts`, id).
+		Scan(&attempts)
+	return attempts, err
+}
+
+func (ss *SQLiteStore) SavePublished(id string, attestation nostr.Event, relays []string) error {
+	_, err := ss.db.Exec(`INSERT INTO published (id, attestation, relays) VALUES (?, ?, ?)
+    ON CONFLICT (id) DO UPDATE SET attestation = excluded.attestation, relays = excluded.relays`,
+		id, attestation.String(), strings.Join(relays, "\n"))
+	return err
+}
+
+func (ss *SQLiteStore) LoadPublished(id string) (attestation nostr.Event, relays []string, err error) {
+	var attestationj, relaysj string
+	if err := ss.db.QueryRow(`SELECT attestation, relays FROM published WHERE id = ?`, id).
+		Scan(&attestationj, &relaysj); err != nil {
+		return attestation, nil, err
+	}
+	if err := json.Unmarshal([]byte(attestationj), &attestation); err != nil {
+		return attestation, nil, fmt.Errorf("error parsing attestation: %w", err)
+	}
+	return attestation, strings.Fields(relaysj), nil
+}
+
+func (ss *SQLiteStore) SavePendingNote(id string, noteID string) error {
+	res, err := ss.db.Exec(`UPDATE stamps SET pending_note = ? WHERE id = ?`, noteID, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (ss *SQLiteStore) PendingNote(id string) (string, error) {
+	var noteID string
+	err := ss.db.QueryRow(`SELECT pending_note FROM stamps WHERE id = ? AND pending_note IS NOT NULL`, id).Scan(&noteID)
+	return noteID, err
+}
+
+func (ss *SQLiteStore) LastSeen() (nostr.Timestamp, error) {
+	var ts int64
+	err := ss.db.QueryRow(`SELECT value FROM state WHERE key = 'last_seen'`).Scan(&ts)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return nostr.Timestamp(ts), err
+}
+
+func (ss *SQLiteStore) SetLastSeen(ts nostr.Timestamp) error {
+	_, err := ss.db.Exec(`INSERT INTO state (key, value) VALUES ('last_seen', ?)
+    ON CONFLICT (key) DO UPDATE SET value = excluded.value`, int64(ts))
+	return err
+}
+
+func (ss *SQLiteStore) queryIDs(query string) ([]string, error) {
+	rows, err := ss.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0, 100)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
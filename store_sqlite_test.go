@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLiteMigrationFillsStampedAt(t *testing.T) {
+	setup(t)
+	path := filepath.Join(s.DataDir, "stamps.db")
+
+	// a database from before stamped_at existed
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := testEvent(t, "old")
+	event.CreatedAt = 1700000000
+	for _, stmt := range []string{
+		`CREATE TABLE stamps (id text NOT NULL PRIMARY KEY, event text NOT NULL, relay text NOT NULL, ots blob,
+      stamp_attempts integer NOT NULL DEFAULT 0)`,
+		`INSERT INTO stamps (id, event, relay, ots) VALUES ('json', '` + event.String() + `', '', x'00')`,
+		`INSERT INTO stamps (id, event, relay, ots) VALUES ('gob', x'0102', '', x'00')`,
+		`INSERT INTO stamps (id, event, relay) VALUES ('unstamped', '` + event.String() + `', '')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	ss, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stampedAt, err := ss.StampedAt("json"); err != nil || stampedAt.Unix() != 1700000000 {
+		t.Errorf("expected the event's created_at, got %v (%v)", stampedAt, err)
+	}
+	if stampedAt, err := ss.StampedAt("gob"); err != nil || time.Since(stampedAt) > time.Minute {
+		t.Errorf("expected now, got %v (%v)", stampedAt, err)
+	}
+	if _, err := ss.StampedAt("unstamped"); err == nil {
+		t.Errorf("an event without an ots shouldn't have a stamp time")
+	}
+}
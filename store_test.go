@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestWriteFileAtomicConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.txt")
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := writeFileAtomic(path, bytes.Repeat([]byte(fmt.Sprint(i%10)), 4096)); err != nil {
+				t.Errorf("write %d failed: %s", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4096 || !bytes.Equal(data, bytes.Repeat(data[:1], 4096)) {
+		t.Errorf("file has mixed writes")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0644 {
+		t.Errorf("file mode is %s", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files were left behind: %d entries", len(entries))
+	}
+}
+
+func BenchmarkEncodeEvent(b *testing.B) {
+	event := nostr.Event{
+		CreatedAt: 1700000000,
+		Kind:      1,
+		Tags: nostr.Tags{
+			{"t", "prediction"},
+			{"p", "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"},
+		},
+		Content: "bitcoin will be above 100k by the end of the year, mark my words",
+	}
+	if err := event.Sign(nostr.GeneratePrivateKey()); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, encoding := range []string{"json", "gob"} {
+		for _, compressed := range []bool{false, true} {
+			name := encoding
+			if compressed {
+				name += "+gzip"
+			}
+			b.Run(name, func(b *testing.B) {
+				s.EventEncoding = encoding
+				s.Compress = compressed
+				var size int
+				for i := 0; i < b.N; i++ {
+					size = len(compress(encodeEvent(event)))
+				}
+				b.ReportMetric(float64(size), "bytes/event")
+			})
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// writeSummary writes a small text file next to the stamp saying what it is and how it's going,
+// for people looking at DATA_DIR directly. it does nothing unless WRITE_SUMMARIES is set.
+func writeSummary(id string, event nostr.Event, status string) {
+	if !s.WriteSummaries {
+		return
+	}
+
+	content := event.Content
+	if runes := []rune(content); len(runes) > 280 {
+		content = string(runes[:280]) + "..."
+	}
+	content = strings.ReplaceAll(content, "\n", "\n  ")
+
+	summary := fmt.Sprintf("event: %s\nauthor: %s\ncreated at: %s\nupdated at: %s\nstatus: %s\ncontent:\n  %s\n",
+		event.ID, event.PubKey,
+		event.CreatedAt.Time().UTC().Format(time.RFC3339),
+		time.Now().UTC().Format(time.RFC3339),
+		status, content)
+
+	path := filepath.Join(s.DataDir, PREFIX_SUMMARY+id+SUFFIX_SUMMARY)
+	if err := writeFileAtomic(path, []byte(summary)); err != nil {
+		slog.Warn("failed to write summary", "event_id", id, "error", err)
+	}
+}
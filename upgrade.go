@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/opentimestamps"
+)
+
+// upgradeLoop tries to upgrade and publish our pending timestamps every UPGRADE_INTERVAL, or earlier
+// when something comes in on blocks, until ctx is canceled
+func upgradeLoop(ctx context.Context, store StampStore, pool *RelayPool, blocks <-chan struct{}) {
+	// a random delay so multiple instances don't all hit the calendars at the same time
+	jitter := time.Duration(rand.Int63n(int64(time.Minute)))
+	if !sleep(ctx, 5*time.Second+jitter) {
+		return
+	}
+
+	var lastTipHeight uint64
+	var lastTipHash string
+	var lastPass time.Time
+
+	for {
+		// events we failed to stamp before get another chance now, unless another instance is doing the stamping
+		if s.Mode == "both" {
+			retryUnstamped(ctx, store)
+		}
+
+		slog.Info("trying to publish events for finalized timestamps")
+
+		ids, err := store.PendingIDs()
+		if err != nil {
+			// maybe the data directory is temporarily unavailable, try again on the next pass
+			slog.Error("error listing pending timestamps", "error", err)
+			if !sleep(ctx, s.UpgradeInterval) {
+				return
+			}
+			continue
+		}
+		pendingTimestamps.Set(float64(len(ids)))
+
+		tipKnown := true
+		blockHeight, blockHash, err := fetchTip(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if lastTipHash == "" {
+				slog.Error("error getting the current block, trying again later", "error", err)
+				if !waitForBlock(ctx, blocks, TIP_RETRY_DELAY*time.Duration(TIP_ATTEMPTS)) {
+					return
+				}
+				continue
+			}
+			// the tip only goes in the "block" tag, we can still upgrade with the last one we know
+			slog.Error("error getting the current block, using the last one", "error", err, "block_hash", lastTipHash)
+			blockHeight, blockHash = lastTipHeight, lastTipHash
+			tipKnown = false
+		}
+
+		// upgrades can only succeed after a new block, but every once in a while we try anyway
+		if tipKnown && blockHash == lastTipHash && time.Since(lastPass) < FORCED_UPGRADE_PASS {
+			slog.Info("no new block, skipping", "block_hash", blockHash)
+		} else {
+			lastTipHeight, lastTipHash = blockHeight, blockHash
+			lastPass = time.Now()
+
+			// process pending timestamps in parallel, but not too much
+			queue := make(chan string)
+			workers := sync.WaitGroup{}
+			for i := 0; i < s.UpgradeConcurrency; i++ {
+				workers.Add(1)
+				go func() {
+					defer workers.Done()
+					for id := range queue {
+						// other instances over the same storage may be at it too
+						unlock, ok := lockID(id)
+						if !ok {
+							slog.Debug("being upgraded elsewhere, skipping", "event_id", id)
+							continue
+						}
+						if err := upgradeAndPublish(ctx, store, pool, id, blockHeight, blockHash); err != nil {
+							slog.Error("failed to upgrade and publish", "event_id", id, "error", err)
+							notifyFailure("upgrade", err)
+						}
+						unlock()
+					}
+				}()
+			}
+			for _, id := range ids {
+				if ctx.Err() != nil {
+					break
+				}
+				queue <- id
+			}
+			close(queue)
+			workers.Wait()
+			if ctx.Err() != nil {
+				return
+			}
+		}
+
+		if !waitForBlock(ctx, blocks, s.UpgradeInterval) {
+			return
+		}
+	}
+}
+
+// fetchTip is getTip but, since esplora hiccups are common, it tries a few times before giving up on knowing the tip
+func fetchTip(ctx context.Context) (height uint64, hash string, err error) {
+	err = retry(ctx, TIP_ATTEMPTS, TIP_RETRY_DELAY, func() (err error) {
+		height, hash, err = getTip(ctx)
+		return err
+	})
+	return height, hash, err
+}
+
+// waitForBlock is like sleep but returns early when a new block arrives
+func waitForBlock(ctx context.Context, blocks <-chan struct{}, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-blocks:
+		return true
+	case <-time.After(d):
+		return true
+	}
+}
+
+// upgradeAndPublish tries to upgrade the pending timestamp for the given id and, if that works,
+// publishes the kind-1040 attestation and removes it from the store.
+// a timestamp that is still pending is not an error.
+func upgradeAndPublish(ctx context.Context, store StampStore, pool *RelayPool, id string, blockHeight uint64, blockHash string) error {
+	if len(id) != 64 {
+		return fmt.Errorf("id is invalid")
+	}
+	slog.Info("trying to upgrade", "event_id", id)
+
+	// read event, relays and ots from store
+	event, eventRelays, data, err := store.Load(id)
+	if err != nil {
+		return fmt.Errorf("error loading: %w", err)
+	}
+	eventRelay := bestRelay(eventRelays)
+	ots, err := opentimestamps.ReadFromFile(data)
+	if err != nil {
+		return fmt.Errorf("error parsing: %w", err)
+	}
+
+	// a previous pass may have upgraded it and failed to publish, then there's nothing to upgrade
+	var newSeq opentimestamps.Sequence
+	if seqs := ots.GetBitcoinAttestedSequences(); len(seqs) > 0 {
+		if err := verifyAttestation(ctx, seqs[0], ots.Digest); err != nil {
+			return fmt.Errorf("stored timestamp doesn't verify: %w", err)
+		}
+		newSeq = seqs[0]
+	} else {
+		progressed := false
+		for i, seq := range ots.Sequences {
+			ictx, cancel := context.WithTimeout(ctx, s.UpgradeTimeout)
+			upgraded, err := upgradeSequence(ictx, seq, ots.Digest)
+			cancel()
+			if err != nil {
+				slog.Info("failed to upgrade", "event_id", id, "error", err)
+				upgradeFailuresTotal.Inc()
+				continue
+			}
+			if upgraded.GetAttestation().BitcoinBlockHeight == 0 {
+				// the calendar has moved it forward but it isn't on bitcoin yet, next time we start from here
+				slog.Info("partially upgraded", "event_id", id, "attestation", upgraded.GetAttestation().Human())
+				ots.Sequences[i] = upgraded
+				progressed = true
+				continue
+			}
+			if err := verifyAttestation(ctx, upgraded, ots.Digest); err != nil {
+				slog.Error("upgraded timestamp doesn't match the block, not publishing", "event_id", id, "error", err)
+				upgradeFailuresTotal.Inc()
+				continue
+			}
+			slog.Info("upgraded", "event_id", id, "block_height", upgraded.GetAttestation().BitcoinBlockHeight)
+			upgradesTotal.Inc()
+			markUpgraded()
+			newSeq = upgraded
+			break
+		}
+
+		if newSeq == nil && progressed {
+			if err := store.Save(id, event, eventRelays, ots.SerializeToFile()); err != nil {
+				slog.Error("failed to save partially upgraded timestamp", "event_id", id, "error", err)
+			}
+		}
+	}
+
+	// calendars sometimes lose commitments, those will never upgrade so we stop trying at some point
+	if newSeq == nil {
+		if stampedAt, err := store.StampedAt(id); err == nil && time.Since(stampedAt) > s.MaxPendingAge {
+			slog.Warn("timestamp is too old and still pending, giving up", "event_id", id,
+				"stamped_at", stampedAt.UTC().Format(time.RFC3339))
+			if err := store.MarkFailed(id); err != nil {
+				return fmt.Errorf("failed to mark as failed: %w", err)
+			}
+			writeSummary(id, event, "gave up, it never got to bitcoin")
+			pendingTimestamps.Dec()
+		}
+		return nil
+	}
+
+	attestation, err := attestationEvent(ctx, event, eventRelay, ots.Digest, newSeq, blockHeight, blockHash)
+	if err != nil {
+		return err
+	}
+
+	// publishToRelays wouldn't send it anyway, but this way the stamp stays as it is
+	if s.DryRun {
+		slog.Info("would publish (dry run)", "event_id", id, "event", attestation)
+		return nil
+	}
+
+	relays := publishRelays(eventRelay, eventRelays)
+
+	// we may have published it before and crashed before deleting it from the store
+	if _, _, err := store.LoadPublished(id); err == nil {
+		slog.Info("attestation was already published", "event_id", id)
+		if err := store.Delete(id); err != nil {
+			slog.Error("failed to delete", "event_id", id, "error", err)
+		}
+		pendingTimestamps.Dec()
+		return nil
+	}
+	// or crashed even before recording it
+	if ie, found := findAttestation(ctx, pool, event.ID, ots.Digest, []string{botPubkey}, relays); found {
+		slog.Info("attestation is already on the relays", "event_id", id, "attestation_id", ie.ID)
+		var on []string
+		if url := relayURL(ie); url != "" {
+			on = []string{url}
+		}
+		if err := store.SavePublished(id, *ie.Event, on); err != nil {
+			slog.Error("failed to record published attestation", "event_id", id, "error", err)
+		}
+		if err := store.Delete(id); err != nil {
+			slog.Error("failed to delete", "event_id", id, "error", err)
+		}
+		pendingTimestamps.Dec()
+		return nil
+	}
+
+	// this must not be interrupted by a shutdown, we'll wait for it to finish.
+	// after a restart many of these may be ready at the same time, so spread them a little
+	stagger(context.WithoutCancel(ctx))
+	slog.Info("publishing", "event_id", id, "event", attestation)
+
+	published := publishToRelays(context.WithoutCancel(ctx), pool, attestation, relays)
+	if others := otherRelays(relays, append(eventRelays, s.Relays...)); len(published) == 0 && len(others) > 0 {
+		slog.Warn("failed to publish to any relay, trying the others", "event_id", id, "relays", others)
+		published = publishToRelays(context.WithoutCancel(ctx), pool, attestation, others)
+	}
+	if len(published) == 0 {
+		// keep the upgraded timestamp so the next pass (or the republish command) can go straight to publishing
+		file := opentimestamps.File{Digest: ots.Digest, Sequences: []opentimestamps.Sequence{newSeq}}
+		if err := store.Save(id, event, eventRelays, file.SerializeToFile()); err != nil {
+			slog.Error("failed to save upgraded timestamp", "event_id", id, "error", err)
+		}
+		return fmt.Errorf("failed to publish to any relay")
+	}
+
+	eventsPublishedTotal.Inc()
+	if err := store.SavePublished(id, attestation, published); err != nil {
+		slog.Error("failed to record published attestation", "event_id", id, "error", err)
+	}
+	writeSummary(id, event, fmt.Sprintf("confirmed in block %d, published as %s to %s",
+		newSeq.GetAttestation().BitcoinBlockHeight, attestation.ID, strings.Join(published, ", ")))
+	if stampedAt, err := store.StampedAt(id); err == nil {
+		elapsed := time.Since(stampedAt)
+		confirmationSeconds.Observe(elapsed.Seconds())
+		slog.Info("published", "event_id", id, "relays", published, "time_to_confirmation", elapsed.Truncate(time.Second).String())
+	} else {
+		slog.Info("published", "event_id", id, "relays", published)
+	}
+	if s.PublishAddressable {
+		publishAddressable(context.WithoutCancel(ctx), pool, attestation, relays)
+	}
+	if s.PostConfirmationNote {
+		postConfirmationNote(context.WithoutCancel(ctx), store, pool, id, event, eventRelay, newSeq, relays)
+	}
+	if err := store.Delete(id); err != nil {
+		slog.Error("failed to delete", "event_id", id, "error", err)
+	}
+	pendingTimestamps.Dec()
+
+	return nil
+}
+
+// publishIfComplete publishes the attestation right away when a calendar has given us a timestamp that is already
+// on bitcoin (it happens with old digests), instead of leaving it for the next upgrade pass
+func publishIfComplete(ctx context.Context, store StampStore, pool *RelayPool, id string) {
+	_, _, data, err := store.Load(id)
+	if err != nil || data == nil {
+		return
+	}
+	ots, err := opentimestamps.ReadFromFile(data)
+	if err != nil || len(ots.GetBitcoinAttestedSequences()) == 0 {
+		return
+	}
+
+	// the upgrade loop may be publishing it at the same time
+	unlock, ok := lockID(id)
+	if !ok {
+		slog.Debug("being published elsewhere, skipping", "event_id", id)
+		return
+	}
+	defer unlock()
+
+	slog.Info("calendar returned a complete timestamp, publishing now", "event_id", id)
+	blockHeight, blockHash, err := getTip(ctx)
+	if err != nil {
+		// the upgrade loop will get to it
+		slog.Warn("error getting the current block", "error", err)
+		return
+	}
+	if err := upgradeAndPublish(ctx, store, pool, id, blockHeight, blockHash); err != nil {
+		slog.Error("failed to publish", "event_id", id, "error", err)
+	}
+}
+
+// attestationEvent builds and signs the kind-1040 event for target with a sequence that ends in a bitcoin attestation,
+// blockHeight and blockHash are the current tip
+func attestationEvent(ctx context.Context, target nostr.Event, targetRelay string, digest []byte, seq opentimestamps.Sequence, blockHeight uint64, blockHash string) (nostr.Event, error) {
+	file := opentimestamps.File{Digest: digest, Sequences: []opentimestamps.Sequence{seq}}
+	event := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      1040,
+		Content:   base64.StdEncoding.EncodeToString(file.SerializeToFile()),
+		Tags: nostr.Tags{
+			nostr.Tag{"e", target.ID, targetRelay},
+			nostr.Tag{"p", target.PubKey},
+			nostr.Tag{"block", strconv.FormatUint(blockHeight, 10), blockHash},
+		},
+	}
+	if hex.EncodeToString(digest) != target.ID {
+		// this is a stamp on the event content, not on its id
+		event.Tags = append(event.Tags, nostr.Tag{"digest", hex.EncodeToString(digest), "content"})
+	}
+	if s.ClientTag != "" {
+		event.Tags = append(event.Tags, nostr.Tag{"client", s.ClientTag})
+	}
+
+	// the time of the block that has the attestation, so clients don't have to look it up
+	if _, header, err := blockAt(ctx, seq.GetAttestation().BitcoinBlockHeight); err != nil {
+		slog.Warn("failed to get block time", "event_id", target.ID, "error", err)
+	} else {
+		blockTime := header.Timestamp.Unix()
+		event.Tags = append(event.Tags, nostr.Tag{"time", strconv.FormatInt(blockTime, 10)})
+
+		// optionally pretend the attestation was published when the block was mined
+		if s.BlockTimeCreatedAt {
+			event.CreatedAt = nostr.Timestamp(blockTime)
+		}
+	}
+
+	if err := event.Sign(s.SecretKey); err != nil {
+		return event, fmt.Errorf("failed to sign: %w", err)
+	}
+	return event, nil
+}
+
+// publishAddressable publishes a copy of the kind-1040 attestation as a parameterized replaceable event of kind
+// ADDRESSABLE_ATTESTATION_KIND with the attested digest (the target event id, unless it's a content stamp) as
+// its "d" tag, so the proof for an event can be fetched directly by its address.
+// failures are only logged since the kind-1040 is the one that matters.
+func publishAddressable(ctx context.Context, pool *RelayPool, attestation nostr.Event, relays []string) {
+	ots, _ := base64.StdEncoding.DecodeString(attestation.Content)
+	file, err := opentimestamps.ReadFromFile(ots)
+	if err != nil {
+		slog.Error("failed to read our own attestation", "attestation_id", attestation.ID, "error", err)
+		return
+	}
+
+	addressable := nostr.Event{
+		CreatedAt: attestation.CreatedAt,
+		Kind:      ADDRESSABLE_ATTESTATION_KIND,
+		Content:   attestation.Content,
+		Tags:      append(nostr.Tags{nostr.Tag{"d", hex.EncodeToString(file.Digest)}}, attestation.Tags...),
+	}
+	if err := addressable.Sign(s.SecretKey); err != nil {
+		slog.Error("failed to sign addressable attestation", "attestation_id", attestation.ID, "error", err)
+		return
+	}
+
+	if published := publishToRelays(ctx, pool, addressable, relays); len(published) == 0 {
+		slog.Warn("failed to publish addressable attestation", "attestation_id", addressable.ID)
+		return
+	}
+	slog.Info("published addressable attestation", "attestation_id", addressable.ID)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCompleteTimestampIsPublishedRightAway(t *testing.T) {
+	h := newHarness(t)
+	s.SkipExisting = false
+
+	// a digest the calendar already has on bitcoin, alone in its block so the id is the merkle root
+	event := testEvent(t, "said it before")
+	h.calendar.complete = 799_990
+	h.esplora.setBlock(799_990, chainhash.Hash(mustHex(t, event.ID)))
+	h.relay.add(event)
+	if !handleEvent(h.ctx, store, h.pool, event, []string{h.relay.url}) {
+		t.Fatal("event wasn't stamped")
+	}
+
+	if attestations := h.relay.attestations(event.ID); len(attestations) != 1 {
+		t.Fatalf("expected the attestation to be published right away, got %d", len(attestations))
+	}
+	if h.calendar.upgradeCalls != 0 {
+		t.Errorf("tried to upgrade a complete timestamp %d times", h.calendar.upgradeCalls)
+	}
+	if store.HasStamp(event.ID) {
+		t.Errorf("stamp wasn't removed from the store after publishing")
+	}
+}
+
+func TestCompleteTimestampThatDoesntVerify(t *testing.T) {
+	h := newHarness(t)
+	s.SkipExisting = false
+
+	// the calendar claims a block whose merkle root has nothing to do with the digest
+	h.calendar.complete = 799_990
+	event := testEvent(t, "said it before")
+	h.relay.add(event)
+	if !handleEvent(h.ctx, store, h.pool, event, []string{h.relay.url}) {
+		t.Fatal("event wasn't stamped")
+	}
+
+	if attestations := h.relay.attestations(event.ID); len(attestations) != 0 {
+		t.Errorf("published %d attestations that don't verify", len(attestations))
+	}
+	if !store.HasStamp(event.ID) {
+		t.Errorf("stamp was removed from the store without publishing")
+	}
+}
+
+func TestFetchTipRetries(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for TIP_RETRY_DELAY")
+	}
+	setup(t)
+	me := newMockEsplora(t, 800_000)
+	me.tipFailures = 1
+	useEsplora(t, me)
+
+	height, hash, err := fetchTip(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get the tip after a single failure: %s", err)
+	}
+	if height != 800_000 || hash != me.chain[800_000].BlockHash().String() {
+		t.Errorf("got tip %d %s", height, hash)
+	}
+	if me.tipCalls != 2 {
+		t.Errorf("expected 2 calls, got %d", me.tipCalls)
+	}
+}
+
+func TestFetchTipStopsOnShutdown(t *testing.T) {
+	setup(t)
+	me := newMockEsplora(t, 800_000)
+	me.tipFailures = TIP_ATTEMPTS
+	useEsplora(t, me)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := fetchTip(ctx); err == nil {
+		t.Fatal("got a tip from a failing esplora")
+	}
+	if elapsed := time.Since(start); elapsed > TIP_RETRY_DELAY {
+		t.Errorf("kept retrying for %s after the context was done", elapsed)
+	}
+}
+
+// crashingStore forgets to delete, like a crash right after publishing
+type crashingStore struct {
+	StampStore
+}
+
+func (crashingStore) Delete(id string) error { return nil }
+
+func TestNoDoublePublishAfterCrash(t *testing.T) {
+	h := newHarness(t)
+	s.SkipExisting = false
+
+	event := testEvent(t, "crash test")
+	h.relay.add(event)
+	if !handleEvent(h.ctx, store, h.pool, event, []string{h.relay.url}) {
+		t.Fatal("event wasn't stamped")
+	}
+	h.confirm(t)
+	height, hash := h.tip(t)
+
+	if err := upgradeAndPublish(h.ctx, crashingStore{store}, h.pool, event.ID, height, hash); err != nil {
+		t.Fatalf("failed to publish: %s", err)
+	}
+	if !store.HasStamp(event.ID) {
+		t.Fatal("stamp was deleted, the crash didn't happen")
+	}
+
+	// after the restart it's still pending, it must be recognized as published from what we recorded,
+	// even if the relay lost it
+	h.relay.mu.Lock()
+	h.relay.events = nil
+	h.relay.mu.Unlock()
+	restarted := NewRelayPool(h.ctx)
+	if err := upgradeAndPublish(h.ctx, store, restarted, event.ID, height, hash); err != nil {
+		t.Fatalf("failed after restart: %s", err)
+	}
+
+	if attestations := h.relay.attestations(event.ID); len(attestations) != 0 {
+		t.Errorf("published %d attestations again", len(attestations))
+	}
+	if store.HasStamp(event.ID) {
+		t.Errorf("stamp wasn't removed after finding it published")
+	}
+}
+
+// crashingEarlierStore forgets to record what it published too, like a crash right after the relays took it
+type crashingEarlierStore struct {
+	crashingStore
+}
+
+func (crashingEarlierStore) SavePublished(id string, attestation nostr.Event, relays []string) error {
+	return nil
+}
+
+func TestNoDoublePublishAfterCrashBeforeRecording(t *testing.T) {
+	h := newHarness(t)
+	s.SkipExisting = false
+
+	event := testEvent(t, "crash test")
+	h.relay.add(event)
+	if !handleEvent(h.ctx, store, h.pool, event, []string{h.relay.url}) {
+		t.Fatal("event wasn't stamped")
+	}
+	h.confirm(t)
+	height, hash := h.tip(t)
+
+	if err := upgradeAndPublish(h.ctx, crashingEarlierStore{crashingStore{store}}, h.pool, event.ID, height, hash); err != nil {
+		t.Fatalf("failed to publish: %s", err)
+	}
+	if _, _, err := store.LoadPublished(event.ID); err == nil {
+		t.Fatal("attestation was recorded, the crash didn't happen")
+	}
+
+	// after the restart it's only on the relay, that's where it must be found
+	restarted := NewRelayPool(h.ctx)
+	if err := upgradeAndPublish(h.ctx, store, restarted, event.ID, height, hash); err != nil {
+		t.Fatalf("failed after restart: %s", err)
+	}
+
+	attestations := h.relay.attestations(event.ID)
+	if len(attestations) != 1 {
+		t.Fatalf("expected one attestation on the relay, got %d", len(attestations))
+	}
+	attestation, relays, err := store.LoadPublished(event.ID)
+	if err != nil {
+		t.Fatalf("attestation found on the relay wasn't recorded: %s", err)
+	}
+	if attestation.ID != attestations[0].ID || len(relays) != 1 || relays[0] != nostr.NormalizeURL(h.relay.url) {
+		t.Errorf("recorded %s on %v", attestation.ID, relays)
+	}
+	if store.HasStamp(event.ID) {
+		t.Errorf("stamp wasn't removed after finding it published")
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// these are set at build time with
+// go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)"
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+func init() {
+	// plain go builds still embed the vcs info
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if commit == "" {
+					commit = setting.Value
+				}
+			case "vcs.time":
+				if date == "" {
+					date = setting.Value
+				}
+			}
+		}
+	}
+}
+
+func versionString() string {
+	if commit == "" {
+		return version
+	}
+	return fmt.Sprintf("%s (commit %s, built %s)", version, commit, date)
+}